@@ -1,19 +1,24 @@
 package main
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	cip "github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/gitlayzer/raccoon/pkg/bridge"
 	"github.com/gitlayzer/raccoon/pkg/config"
 	"github.com/gitlayzer/raccoon/pkg/ipam"
 	"github.com/gitlayzer/raccoon/pkg/store"
+	"github.com/vishvananda/netlink"
 )
 
 const (
@@ -24,10 +29,16 @@ func main() {
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString(pluginName))
 }
 
-// 实现 cmdAdd 函数
-func cmdAdd(args *skel.CmdArgs) error {
+// 实现 cmdAdd 函数, 任意一步失败时会撤销之前的所有操作
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	// 加载配置文件
-	c, err := config.LoadCNIConfig(args.StdinData)
+	c, err := config.LoadCNIConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	// 在创建任何资源之前检查 sysctl 是否允许
+	sysctls, err := c.PodSysctls(args.IfName)
 	if err != nil {
 		return err
 	}
@@ -39,89 +50,633 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer s.Close()
 
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns: %v", err)
+	}
+	defer netns.Close()
+
+	// 失败时按相反的顺序执行撤销操作
+	var undo rollback
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rerr := undo.run(); rerr != nil {
+			err = fmt.Errorf("%v, rollback failed: %v", err, rerr)
+		}
+	}()
+
 	// 创建 IPAM 管理器
 	ipam, err := ipam.NewIPAddressManagement(c, s)
 	if err != nil {
 		return fmt.Errorf("failed to create IPAM manager: %v", err)
 	}
 
+	// 记录为容器选择的租户网络, DEL 和 CHECK 不再根据当前的命名空间标签选择网络
+	if c.Name != c.DefaultNetwork {
+		if err := recordTenant(c, args.ContainerID, &undo); err != nil {
+			return err
+		}
+	}
+
+	var result *current.Result
+	var ip net.IP
+	switch c.Mode {
+	case config.ModePTP, config.ModeFlat:
+		// flat 模式与 ptp 模式的区别只在于地址来自宿主机子网
+		result, ip, err = addPTP(args, c, ipam, netns, &undo)
+	case config.ModeMacvlan, config.ModeIPvlan:
+		result, ip, err = addSubInterface(args, c, ipam, netns, &undo)
+	default:
+		// tap 模式在网桥模式的基础上创建 tap 设备
+		result, ip, err = addBridge(args, c, ipam, netns, &undo)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 附加网络的路由添加在配置了地址的网卡上, 默认经由该地址的网关
+	if len(c.Routes) > 0 {
+		ipc := result.IPs[0]
+		for _, cfg := range result.IPs {
+			if cfg.Address.IP.Equal(ip) {
+				ipc = cfg
+				break
+			}
+		}
+
+		ifName := args.IfName
+		if ipc.Interface != nil {
+			ifName = result.Interfaces[*ipc.Interface].Name
+		}
+
+		if err := bridge.AddRoutes(netns, ifName, c.Routes, ipc.Gateway); err != nil {
+			return err
+		}
+
+		for _, route := range c.Routes {
+			r := *route
+			if r.GW == nil {
+				r.GW = ipc.Gateway
+			}
+			result.Routes = append(result.Routes, &r)
+		}
+	}
+
+	if err := bridge.SetSysctls(netns, args.IfName, sysctls); err != nil {
+		return err
+	}
+
+	if c.IPMasq {
+		chain, comment := ipMasqChain(c.Name, args.ContainerID), ipMasqComment(c.Name, args.ContainerID)
+		undo.add(func() error {
+			return cip.TeardownIPMasq(ipam.IpNet(ip), chain, comment)
+		})
+		if err := cip.SetupIPMasq(ipam.IpNet(ip), chain, comment); err != nil {
+			return fmt.Errorf("failed to setup ip masquerade: %v", err)
+		}
+	}
+
+	// 作为链式插件时保留之前插件返回的 DNS 配置
+	if !c.DNS.IsEmpty() {
+		result.DNS = c.DNS
+	}
+
+	return types.PrintResult(result, c.CNIVersion)
+}
+
+// addBridge 创建网桥并将容器接入网桥
+func addBridge(args *skel.CmdArgs, c *config.CNIConfig, ipam *ipam.IPAddressManagement, netns ns.NetNS, undo *rollback) (*current.Result, net.IP, error) {
 	gateway := ipam.Gateway()
 
-	// 获取分配的 IP 地址
-	ip, err := ipam.AllocateIP(args.ContainerID, args.IfName)
+	br, err := bridge.CreateBridge(c.PluginConfig.Bridge, c.PluginConfig.MTU, *ipam.IpNet(gateway), c.PromiscMode)
 	if err != nil {
-		return fmt.Errorf("failed to allocate IP address: %v", err)
+		return nil, nil, fmt.Errorf("failed to create bridge: %v", err)
 	}
 
-	mtu := 1500
+	if c.PluginConfig.VLAN != 0 {
+		if err := bridge.SetupBridgeVlan(br, c.PluginConfig.VLAN); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	br, err := bridge.CreateBridge(c.Bridge, mtu, *ipam.IpNet(gateway))
+	// 不作为默认网关时, 容器中不添加默认路由
+	defaultGateway := gateway
+	if !c.IsDefaultGateway {
+		defaultGateway = nil
+	}
+
+	// 作为链式插件时, 将 prevResult 中已经存在的网卡接入网桥, 否则创建 veth pair
+	if c.PrevResult != nil {
+		if c.Mode == config.ModeTap {
+			return nil, nil, fmt.Errorf("plugin chaining is not supported in %s mode", c.Mode)
+		}
+		return addChained(args, c, ipam, br, netns, defaultGateway, undo)
+	}
+
+	return addVethPair(args, c, ipam, br, netns, defaultGateway, undo)
+}
+
+// addPTP 分配 IP 地址并创建点对点的 veth pair, 不创建网桥
+func addPTP(args *skel.CmdArgs, c *config.CNIConfig, ipam *ipam.IPAddressManagement, netns ns.NetNS, undo *rollback) (*current.Result, net.IP, error) {
+	if c.PrevResult != nil {
+		return nil, nil, fmt.Errorf("plugin chaining is not supported in %s mode", c.Mode)
+	}
+
+	ip, allocated, err := ipam.AllocateIP(args.ContainerID, args.IfName)
 	if err != nil {
-		return fmt.Errorf("failed to create bridge: %v", err)
+		return nil, nil, fmt.Errorf("failed to allocate IP address: %v", err)
+	}
+	// 重试的 ADD 复用之前分配的地址, 失败时不能释放
+	if allocated {
+		undo.add(func() error {
+			return ipam.ReleaseIP(args.ContainerID)
+		})
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	hostVethName := bridge.HostVethName(args.ContainerID, args.IfName)
+	if err := undoLink(netns, args.IfName, hostVethName, undo); err != nil {
+		return nil, nil, err
+	}
+	hostInterface, containerInterface, err := bridge.SetupPTP(netns, c.PluginConfig.MTU, args.IfName, hostVethName, podMAC(c, ip), ip, c.IsDefaultGateway)
 	if err != nil {
-		return fmt.Errorf("failed to open netns: %v", err)
+		return nil, nil, fmt.Errorf("failed to setup ptp veth pair: %v", err)
 	}
 
-	defer netns.Close()
+	if err := ipam.RecordLink(args.ContainerID, hostInterface.Name, containerInterface.Mac); err != nil {
+		return nil, nil, fmt.Errorf("failed to record host veth: %v", err)
+	}
 
-	if err := bridge.SetupVethPair(netns, br, mtu, args.IfName, ipam.IpNet(ip), gateway); err != nil {
-		return fmt.Errorf("failed to setup veth pair: %v", err)
+	// 结果中依次包含宿主机端网卡和容器端网卡
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{hostInterface, containerInterface},
+		IPs: []*current.IPConfig{
+			{
+				Interface: current.Int(1),
+				Address:   net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+				Gateway:   bridge.PTPGateway,
+			},
+		},
+	}
+
+	if c.IsDefaultGateway {
+		result.Routes = []*types.Route{defaultRoute(bridge.PTPGateway)}
+	}
+
+	return result, ip, nil
+}
+
+// addSubInterface 分配 IP 地址并在宿主机网卡上创建 macvlan 或 ipvlan 子接口
+func addSubInterface(args *skel.CmdArgs, c *config.CNIConfig, ipam *ipam.IPAddressManagement, netns ns.NetNS, undo *rollback) (*current.Result, net.IP, error) {
+	if c.PrevResult != nil {
+		return nil, nil, fmt.Errorf("plugin chaining is not supported in %s mode", c.Mode)
+	}
+
+	if c.Master == "" {
+		return nil, nil, fmt.Errorf("master is required in %s mode", c.Mode)
+	}
+
+	network, gateway, err := underlay(c, ipam)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip, allocated, err := ipam.AllocateIP(args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to allocate IP address: %v", err)
+	}
+	// 重试的 ADD 复用之前分配的地址, 失败时不能释放
+	if allocated {
+		undo.add(func() error {
+			return ipam.ReleaseIP(args.ContainerID)
+		})
+	}
+
+	// ipvlan 的 l3 模式下默认路由直接经由网卡
+	l3 := c.Mode == config.ModeIPvlan && c.IPvlanMode == config.IPvlanModeL3
+	defaultGateway := gateway
+	if !c.IsDefaultGateway {
+		defaultGateway = nil
+	}
+	podIP := &net.IPNet{IP: ip, Mask: network.Mask}
+
+	if err := undoLink(netns, args.IfName, "", undo); err != nil {
+		return nil, nil, err
+	}
+
+	var containerInterface *current.Interface
+	if c.Mode == config.ModeMacvlan {
+		containerInterface, err = bridge.SetupMacvlan(netns, c.Master, c.PluginConfig.MTU, args.IfName, podIP, defaultGateway)
+	} else {
+		containerInterface, err = bridge.SetupIPvlan(netns, c.Master, l3, c.PluginConfig.MTU, args.IfName, podIP, defaultGateway)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to setup %s: %v", c.Mode, err)
 	}
 
 	result := &current.Result{
 		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{containerInterface},
 		IPs: []*current.IPConfig{
 			{
-				Address: net.IPNet{IP: ip, Mask: ipam.Mask()},
-				Gateway: gateway,
+				Interface: current.Int(0),
+				Address:   *podIP,
+				Gateway:   gateway,
 			},
 		},
 	}
 
-	return types.PrintResult(result, c.CNIVersion)
+	if defaultGateway != nil {
+		route := defaultRoute(defaultGateway)
+		if l3 {
+			route.GW = nil
+		}
+		result.Routes = []*types.Route{route}
+	}
+
+	return result, ip, nil
 }
 
-// 实现 cmdDel 函数
-func cmdDel(args *skel.CmdArgs) error {
-	c, err := config.LoadCNIConfig(args.StdinData)
+// addVethPair 分配 IP 地址并创建接入网桥的 veth pair
+func addVethPair(args *skel.CmdArgs, c *config.CNIConfig, ipam *ipam.IPAddressManagement, br netlink.Link, netns ns.NetNS, defaultGateway net.IP, undo *rollback) (*current.Result, net.IP, error) {
+	// 获取分配的 IP 地址
+	ip, allocated, err := ipam.AllocateIP(args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to allocate IP address: %v", err)
+	}
+	// 重试的 ADD 复用之前分配的地址, 失败时不能释放
+	if allocated {
+		undo.add(func() error {
+			return ipam.ReleaseIP(args.ContainerID)
+		})
+	}
+
+	hostVethName := bridge.HostVethName(args.ContainerID, args.IfName)
+	if err := undoLink(netns, args.IfName, hostVethName, undo); err != nil {
+		return nil, nil, err
+	}
+	// tap 模式下地址配置在 tap 上而不是容器端 veth 上
+	podIP := ipam.IpNet(ip)
+	if c.Mode == config.ModeTap {
+		podIP = nil
+	}
+
+	hostInterface, containerInterface, err := bridge.SetupVethPair(netns, br, c.PluginConfig.MTU, args.IfName, hostVethName, podMAC(c, ip), podIP, defaultGateway, c.HairpinMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to setup veth pair: %v", err)
+	}
+
+	if err := ipam.RecordLink(args.ContainerID, hostInterface.Name, containerInterface.Mac); err != nil {
+		return nil, nil, fmt.Errorf("failed to record host veth: %v", err)
+	}
+
+	if c.PluginConfig.VLAN != 0 {
+		if err := bridge.SetPortVlan(hostInterface.Name, c.PluginConfig.VLAN); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 结果中依次包含网桥、宿主机端网卡和容器端网卡, tap 模式下最后是 tap 设备
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{bridgeInterface(br), hostInterface, containerInterface},
+		IPs: []*current.IPConfig{
+			{
+				Interface: current.Int(2),
+				Address:   *ipam.IpNet(ip),
+				Gateway:   ipam.Gateway(),
+			},
+		},
+	}
+
+	if c.Mode == config.ModeTap {
+		undo.add(func() error {
+			return bridge.DelTap(netns, c.TapName)
+		})
+		tapInterface, err := bridge.SetupTap(netns, args.IfName, c.TapName, c.TapRedirect == config.TapRedirectMacvtap, c.PluginConfig.MTU, ipam.IpNet(ip), defaultGateway)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to setup tap: %v", err)
+		}
+
+		result.Interfaces = append(result.Interfaces, tapInterface)
+		result.IPs[0].Interface = current.Int(3)
+	}
+
+	if defaultGateway != nil {
+		result.Routes = []*types.Route{defaultRoute(defaultGateway)}
+	}
+
+	return result, ip, nil
+}
+
+// undoLink 在网卡还不存在时注册删除网卡的撤销操作
+// 网卡可能只创建了一半, 删除容器端网卡会同时删除宿主机端网卡和地址
+// 重试的 ADD 中网卡已经存在, 创建会失败, 这时不能删除之前的 ADD 创建的网卡
+func undoLink(netns ns.NetNS, ifName, hostVethName string, undo *rollback) error {
+	exists, err := bridge.LinkExists(netns, ifName, hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if !exists {
+		undo.add(func() error {
+			return bridge.DelVethPair(netns, ifName, hostVethName, false)
+		})
+	}
+
+	return nil
+}
+
+// addChained 将 prevResult 中的容器网卡接入网桥, prevResult 中没有该网卡的地址时从 IPAM 分配
+func addChained(args *skel.CmdArgs, c *config.CNIConfig, ipam *ipam.IPAddressManagement, br netlink.Link, netns ns.NetNS, defaultGateway net.IP, undo *rollback) (*current.Result, net.IP, error) {
+	result, err := current.NewResultFromResult(c.PrevResult)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
+	ifIndex := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name == args.IfName && iface.Sandbox != "" {
+			ifIndex = i
+			break
+		}
+	}
+	if ifIndex < 0 {
+		return nil, nil, fmt.Errorf("interface %q not found in prevResult", args.IfName)
+	}
+
+	// 使用 prevResult 中已有的地址, 并在存储中记录, 没有时从 IPAM 分配
+	var ip net.IP
+	var podIP *net.IPNet
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == ifIndex && ipc.Address.IP.To4() != nil {
+			ip = ipc.Address.IP
+			break
+		}
+	}
+
+	var allocated bool
+	if ip != nil {
+		if allocated, err = ipam.ReserveIP(ip, args.ContainerID, args.IfName); err != nil {
+			return nil, nil, fmt.Errorf("failed to reserve IP address: %v", err)
+		}
+	} else {
+		if ip, allocated, err = ipam.AllocateIP(args.ContainerID, args.IfName); err != nil {
+			return nil, nil, fmt.Errorf("failed to allocate IP address: %v", err)
+		}
+		podIP = ipam.IpNet(ip)
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Interface: current.Int(ifIndex),
+			Address:   *podIP,
+			Gateway:   ipam.Gateway(),
+		})
+	}
+	// 重试的 ADD 复用之前记录的地址, 失败时不能释放
+	if allocated {
+		undo.add(func() error {
+			return ipam.ReleaseIP(args.ContainerID)
+		})
+	}
+
+	// DEL 时不能删除之前的插件创建的 veth
+	if err := ipam.RecordChained(args.ContainerID); err != nil {
+		return nil, nil, fmt.Errorf("failed to record chained veth: %v", err)
+	}
+
+	undo.add(func() error {
+		return bridge.DetachVeth(netns, args.IfName, podIP)
+	})
+	hostInterface, err := bridge.AttachVeth(netns, br, c.PluginConfig.MTU, args.IfName, podIP, defaultGateway, c.HairpinMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to attach %q to bridge: %v", args.IfName, err)
+	}
+
+	if c.PluginConfig.VLAN != 0 {
+		if err := bridge.SetPortVlan(hostInterface.Name, c.PluginConfig.VLAN); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	result.Interfaces = append(result.Interfaces, bridgeInterface(br), hostInterface)
+
+	// 默认路由已经被替换为经由网关的路由
+	if defaultGateway != nil {
+		routes := []*types.Route{defaultRoute(defaultGateway)}
+		for _, route := range result.Routes {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 || route.Dst.IP.To4() == nil {
+				routes = append(routes, route)
+			}
+		}
+		result.Routes = routes
+	}
+
+	return result, ip, nil
+}
+
+// bridgeInterface 返回网桥在结果中的网卡信息
+func bridgeInterface(br netlink.Link) *current.Interface {
+	return &current.Interface{
+		Name: br.Attrs().Name,
+		Mac:  br.Attrs().HardwareAddr.String(),
+	}
+}
+
+// podMAC 返回根据容器地址生成的 MAC 地址, 未开启 macFromIP 时返回空字符串
+func podMAC(c *config.CNIConfig, ip net.IP) string {
+	if !c.MacFromIP {
+		return ""
+	}
+
+	return bridge.PodMAC(ip).String()
+}
+
+// defaultRoute 返回经由网关的默认路由
+func defaultRoute(gateway net.IP) *types.Route {
+	return &types.Route{
+		Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		GW:  gateway,
+	}
+}
+
+// recordTenant 在默认网络的存储中记录容器的租户网络, 失败时撤销记录
+func recordTenant(c *config.CNIConfig, id string, undo *rollback) error {
+	s, err := store.NewStore(c.DataDir, c.DefaultNetwork)
 	if err != nil {
 		return err
 	}
+	defer s.Close()
+
+	if err := ipam.RecordTenant(s, id, c.Name); err != nil {
+		return fmt.Errorf("failed to record tenant network: %v", err)
+	}
+	undo.add(func() error {
+		return forgetTenant(c, id)
+	})
 
-	s, err := store.NewStore(c.DataDir, c.Name)
+	return nil
+}
+
+// forgetTenant 删除默认网络的存储中容器的租户网络记录
+func forgetTenant(c *config.CNIConfig, id string) error {
+	s, err := store.NewStore(c.DataDir, c.DefaultNetwork)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	ipam, err := ipam.NewIPAddressManagement(c, s)
+	return ipam.ForgetTenant(s, id)
+}
+
+// containerTenant 返回 ADD 时为容器选择的租户网络, 使用默认网络时返回空字符串
+// 没有记录的容器按当前的命名空间标签选择
+func containerTenant(args *skel.CmdArgs) (string, error) {
+	pluginConf, err := config.LoadPluginConfig(args.StdinData)
 	if err != nil {
-		return fmt.Errorf("failed to create IPAM manager: %v", err)
+		return "", err
 	}
 
-	if err := ipam.ReleaseIP(args.ContainerID); err != nil {
-		return fmt.Errorf("failed to release IP address: %v", err)
+	s, err := store.NewStore(pluginConf.DataDir, pluginConf.DefaultNetwork)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	tenant, ok, err := ipam.LookupTenant(s, args.ContainerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup tenant network: %v", err)
+	}
+	if ok {
+		return tenant, nil
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	return config.TenantNetwork(pluginConf, args.Args)
+}
+
+// delTarget 是 DEL 使用的网络配置和存储, 以及存储中记录的宿主机端 veth
+type delTarget struct {
+	c        *config.CNIConfig
+	s        *store.Store
+	hostVeth string
+	chained  bool
+}
+
+// loadDelTarget 加载网络配置并读取存储, tenant 为空时使用默认网络
+func loadDelTarget(args *skel.CmdArgs, tenant string) (*delTarget, error) {
+	c, err := config.LoadCNIConfigForTenant(args.StdinData, tenant)
+	if errors.Is(err, os.ErrNotExist) {
+		// raccoond 尚未写入或已经删除子网配置, 仍然需要释放存储中的记录
+		c, err = config.LoadCNIConfigWithoutSubnet(args.StdinData, tenant)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to open netns: %v", err)
+		return nil, err
+	}
+
+	s, err := store.NewStore(c.DataDir, c.Name)
+	if err != nil {
+		return nil, err
 	}
-	defer netns.Close()
 
-	return bridge.DelVethPair(netns, args.IfName)
+	hostVeth, chained, err := ipam.LookupHostVeth(s, args.ContainerID)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to lookup host veth: %v", err)
+	}
+
+	return &delTarget{c: c, s: s, hostVeth: hostVeth, chained: chained}, nil
 }
 
-// 实现 cmdCheck 函数
+// 实现 cmdDel 函数, 网络命名空间或子网配置已经不存在时仍然返回成功
+func cmdDel(args *skel.CmdArgs) error {
+	// 租户网络的记录、tenants.json 或租户网络的存储无法读取时按默认网络删除, DEL 保持幂等
+	tenant, err := containerTenant(args)
+	if err != nil {
+		tenant = ""
+	}
+
+	t, err := loadDelTarget(args, tenant)
+	if err != nil && tenant != "" {
+		t, err = loadDelTarget(args, "")
+	}
+	if err != nil {
+		return err
+	}
+	defer t.s.Close()
+	c, s := t.c, t.s
+
+	// 优先使用存储中记录的宿主机端 veth 名称
+	hostVethName := t.hostVeth
+	if hostVethName == "" {
+		hostVethName = bridge.HostVethName(args.ContainerID, args.IfName)
+	}
+
+	// SNAT 规则由容器地址匹配, 先清理规则再释放地址, 清理失败时重试的 DEL 仍然可以找到地址
+	if c.IPMasq {
+		ip, err := ipam.LookupIP(s, args.ContainerID)
+		if err != nil {
+			return fmt.Errorf("failed to lookup IP address: %v", err)
+		}
+		if ip != nil {
+			if err := cip.TeardownIPMasq(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, ipMasqChain(c.Name, args.ContainerID), ipMasqComment(c.Name, args.ContainerID)); err != nil {
+				return fmt.Errorf("failed to teardown ip masquerade: %v", err)
+			}
+		}
+	}
+
+	if _, err := ipam.ReleaseIPByContainerID(s, args.ContainerID); err != nil {
+		return fmt.Errorf("failed to release IP address: %v", err)
+	}
+
+	if tenant != "" {
+		if err := forgetTenant(c, args.ContainerID); err != nil {
+			return fmt.Errorf("failed to forget tenant network: %v", err)
+		}
+	}
+
+	// 网络命名空间已经被删除时, 只清理宿主机端网卡
+	var netns ns.NetNS
+	if args.Netns != "" {
+		netns, err = ns.GetNS(args.Netns)
+		if err != nil {
+			if _, ok := err.(ns.NSPathNotExistErr); !ok {
+				return fmt.Errorf("failed to open netns: %v", err)
+			}
+		} else {
+			defer netns.Close()
+		}
+	}
+
+	// tap 设备是持久化的, 网络命名空间仍然存在时需要单独删除
+	if c.Mode == config.ModeTap && netns != nil {
+		if err := bridge.DelTap(netns, c.TapName); err != nil {
+			return fmt.Errorf("failed to delete tap: %v", err)
+		}
+	}
+
+	return bridge.DelVethPair(netns, args.IfName, hostVethName, t.chained)
+}
+
+// 实现 cmdCheck 函数, 根据 prevResult 检查容器网络
 func cmdCheck(args *skel.CmdArgs) error {
-	c, err := config.LoadCNIConfig(args.StdinData)
+	tenant, err := containerTenant(args)
+	if err != nil {
+		return err
+	}
+
+	c, err := config.LoadCNIConfigForTenant(args.StdinData, tenant)
 	if err != nil {
 		return err
 	}
 
+	if c.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+
+	result, err := current.NewResultFromResult(c.PrevResult)
+	if err != nil {
+		return fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
 	s, err := store.NewStore(c.DataDir, c.Name)
 	if err != nil {
 		return err
@@ -138,11 +693,139 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to check IP address: %v", err)
 	}
 
+	// prevResult 中的地址必须是分配给容器的地址
+	found := false
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.Equal(ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("allocated IP address %s is missing in prevResult", ip)
+	}
+
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
 		return fmt.Errorf("failed to open netns: %v", err)
 	}
 	defer netns.Close()
 
-	return bridge.CheckVethPair(netns, args.IfName, ip)
+	gateway := ipam.Gateway()
+	if c.Mode == config.ModePTP || c.Mode == config.ModeFlat {
+		gateway = bridge.PTPGateway
+	}
+
+	defaultGateway := gateway
+	if !c.IsDefaultGateway {
+		defaultGateway = nil
+	}
+
+	if c.Mode == config.ModeMacvlan || c.Mode == config.ModeIPvlan {
+		_, gateway, err := underlay(c, ipam)
+		if err != nil {
+			return err
+		}
+		defaultGateway = gateway
+		if !c.IsDefaultGateway {
+			defaultGateway = nil
+		}
+	}
+
+	switch c.Mode {
+	case config.ModeMacvlan:
+		return bridge.CheckSubInterface(netns, args.IfName, "macvlan", c.Master, c.PluginConfig.MTU, result, defaultGateway)
+	case config.ModeIPvlan:
+		// l3 模式下默认路由没有网关
+		if c.IPvlanMode == config.IPvlanModeL3 {
+			defaultGateway = nil
+		}
+		return bridge.CheckSubInterface(netns, args.IfName, "ipvlan", c.Master, c.PluginConfig.MTU, result, defaultGateway)
+	}
+
+	// tap 模式下地址和默认路由在 tap 上
+	vethGateway := defaultGateway
+	if c.Mode == config.ModeTap {
+		if err := bridge.CheckTap(netns, c.TapName, c.PluginConfig.MTU, result, defaultGateway); err != nil {
+			return err
+		}
+		vethGateway = nil
+	}
+
+	hostVethIndex, err := bridge.CheckVethPair(netns, args.IfName, c.PluginConfig.MTU, result, vethGateway)
+	if err != nil {
+		return err
+	}
+
+	if c.Mode == config.ModePTP || c.Mode == config.ModeFlat {
+		return bridge.CheckPTP(hostVethIndex, c.PluginConfig.MTU, ip)
+	}
+
+	if err := bridge.CheckBridge(c.PluginConfig.Bridge, hostVethIndex, c.PluginConfig.MTU, ipam.IpNet(gateway), result); err != nil {
+		return err
+	}
+
+	if c.PluginConfig.VLAN != 0 {
+		return bridge.CheckPortVlan(hostVethIndex, c.PluginConfig.VLAN)
+	}
+
+	return nil
+}
+
+// ipMasqChain 生成容器的 SNAT 链名称, iptables 链名称最长为 28 个字符
+func ipMasqChain(network, containerID string) string {
+	return fmt.Sprintf("RACCOON-%.10x", sha256.Sum256([]byte(network+containerID)))
+}
+
+// ipMasqComment 生成容器的 SNAT 规则注释
+func ipMasqComment(network, containerID string) string {
+	return fmt.Sprintf("name: %q id: %q", network, containerID)
+}
+
+// underlay 返回 macvlan 和 ipvlan 模式下容器所在的底层网段和默认网关
+// 容器直接接入 master 所在的二层网络, 地址必须来自该网段, 例如 flat 网络的地址块, 网关是底层网络的路由器而不是 cni0
+func underlay(c *config.CNIConfig, im *ipam.IPAddressManagement) (*net.IPNet, net.IP, error) {
+	network, gateway, err := bridge.UnderlayNetwork(c.Master)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subnet := im.Subnet()
+	ones, _ := network.Mask.Size()
+	subnetOnes, _ := subnet.Mask.Size()
+	if !network.Contains(subnet.IP) || subnetOnes < ones {
+		return nil, nil, fmt.Errorf("subnet %s is not in the network %s of master %q, use a flat network in %s mode", subnet, network, c.Master, c.Mode)
+	}
+
+	if c.Gateway != "" {
+		gateway = net.ParseIP(c.Gateway).To4()
+		if !network.Contains(gateway) {
+			return nil, nil, fmt.Errorf("gateway %s is not in the network %s of master %q", gateway, network, c.Master)
+		}
+	}
+	if gateway == nil && c.IsDefaultGateway {
+		return nil, nil, fmt.Errorf("master %q has no default route, set gateway in %s mode", c.Master, c.Mode)
+	}
+
+	return network, gateway, nil
+}
+
+// rollback 记录 ADD 过程中每一步的撤销操作
+type rollback []func() error
+
+// add 注册一个撤销操作
+func (r *rollback) add(f func() error) {
+	*r = append(*r, f)
+}
+
+// run 按注册的相反顺序执行所有撤销操作, 并汇总所有错误
+func (r rollback) run() error {
+	var errs []error
+	for i := len(r) - 1; i >= 0; i-- {
+		if err := r[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
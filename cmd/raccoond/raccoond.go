@@ -3,58 +3,196 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/gitlayzer/raccoon/pkg/backend"
+	"github.com/gitlayzer/raccoon/pkg/bgp"
 	"github.com/gitlayzer/raccoon/pkg/bridge"
 	raccoonConf "github.com/gitlayzer/raccoon/pkg/config"
+	"github.com/gitlayzer/raccoon/pkg/ipam"
+	"github.com/gitlayzer/raccoon/pkg/policy"
+	"github.com/gitlayzer/raccoon/pkg/store"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 )
 
 const (
 	appName = "raccoond"
+
+	isolationChain = "RACCOON-ISOLATION"
+
+	flatClaimRetries = 5               // 认领 flat 网络地址块的最大次数
+	flatClaimBackoff = 2 * time.Second // 写入地址块后重新检查之前等待的时间, 实际等待时间随机增加最多一倍
+
+	sysctlsAnnotation = "raccoon.io/sysctls" // 记录节点 sysctl 的注解
+	annotationPrefix  = "raccoon.io/"        // raccoon 在节点上的注解前缀, 变化时重新调谐
+
+	encryptionWireGuard = "wireguard" // 节点之间的容器流量经由 WireGuard 加密
+	encryptionIPsec     = "ipsec"     // 节点之间的容器流量经由 IPsec 隧道模式加密
+
+	ipsecPSKKey = "psk" // Secret 中预共享密钥的键
+
+	bgpGroupNode          = "node"          // BGP 通告的本节点子网
+	bgpGroupServices      = "services"      // BGP 通告的 Service 网段
+	bgpGroupLoadBalancers = "loadbalancers" // BGP 通告的 LoadBalancer 地址
+
+	policyKey = "networkpolicy" // 网络策略控制器的唯一调谐对象, 任何变化都重新生成全部规则
 )
 
 var (
 	log = logf.Log.WithName(appName)
+
+	// backendNames 是所有后端的名称, 启动时清理其中不再使用的后端的残留状态
+	backendNames = []string{backend.NameHostGW, backend.NameVXLAN, backend.NameIPIP, backend.NameGeneve}
 )
 
 type DaemonConfig struct {
-	clusterCIDR    string
-	nodeName       string
-	enableIptables bool
+	clusterCIDR         string
+	nodeName            string
+	enableIptables      bool
+	encapOverhead       int
+	cniConfFile         string
+	cniConfDir          string
+	enablePortmap       bool
+	enableBandwidth     bool
+	networksFile        string
+	backend             string
+	vxlanVNI            int
+	vxlanPort           int
+	geneveVNI           int
+	genevePort          int
+	crossSubnet         bool
+	encryption          string
+	wireguardPort       int
+	ipsecSecret         string
+	ipsecRekey          time.Duration
+	bgpAS               uint
+	bgpPeers            []bgp.PeerConfig
+	bgpServiceCIDRs     []*net.IPNet
+	bgpAdvertiseLB      bool
+	enableNetworkPolicy bool
+	sysctlDir           string
 }
 
 type Reconciler struct {
 	client      client.Client
+	reader      client.Reader
 	clusterCIDR *net.IPNet
 
 	hostLink     netlink.Link
+	hostIP       net.IP
+	nodeCIDR     *net.IPNet
 	routes       map[string]netlink.Route
 	config       *DaemonConfig
+	pluginConfig *raccoonConf.PluginConfig // --cni-conf-file 中默认网络的插件配置
 	subnetConfig *raccoonConf.SubnetConfig
+	networks     []raccoonConf.NetworkConfig
+	vlanBridges  map[string]netlink.Link           // VLAN 网络的网桥, 到其他节点子网的路由经由网桥
+	hostGW       *backend.HostGW                   // cross-subnet 时直接路由到同一子网的对端节点
+	backends     map[string]backend.Backend        // 已经初始化的后端, 切换期间同时包括新旧后端
+	active       string                            // 当前用于发送的后端
+	peers        map[string]map[string]bool        // 每个后端已经建立的对端节点
+	wireguard    netlink.Link                      // WireGuard 设备, 未开启时为空
+	wgKey        *backend.WireGuardKey             // 本节点的 WireGuard 私钥
+	wgPeers      map[string]*backend.WireGuardPeer // 已经写入 WireGuard 设备的对端节点
+	xfrmStates   map[string]netlink.XfrmState      // 已经添加的 IPsec state
+	xfrmPolicies map[string]netlink.XfrmPolicy     // 已经添加的 IPsec policy
+	bootID       string                            // 本节点的 boot_id, 用于派生 IPsec 发送方向的密钥
+}
+
+// ServiceReconciler 收集 LoadBalancer 类型 Service 的地址, 交给 BGP 发言者通告
+type ServiceReconciler struct {
+	client  client.Client
+	speaker *bgp.Speaker
+}
+
+// PolicyReconciler 将 NetworkPolicy 编译为本节点 Pod 的 iptables 规则和 ipset
+type PolicyReconciler struct {
+	client   client.Client
+	recorder record.EventRecorder // 在无法限制的 Pod 上记录事件
+	nodeName string
+	dataDir  string // 插件的存储目录, 每次同步时从所有网络的存储中查找 Pod 地址对应的宿主机端 veth
+}
+
+// TenantReconciler 根据命名空间的 TenantLabel 标签生成命名空间到租户网络的映射
+type TenantReconciler struct {
+	client  client.Client
+	tenants map[string]bool // 租户网络的名称
 }
 
 func (d *DaemonConfig) addFlags() {
 	flag.StringVar(&d.clusterCIDR, "cluster-cidr", "", "cluster pod network cidr")
 	flag.StringVar(&d.nodeName, "node-name", "", "current node name")
 	flag.BoolVar(&d.enableIptables, "enable-iptables", false, "add iptables forward and nat rules")
+	flag.IntVar(&d.encapOverhead, "encap-overhead", -1, "bytes subtracted from the host link mtu for the pod mtu, -1 uses the largest overhead of the encryption and the backends still in use on this node")
+	flag.StringVar(&d.cniConfFile, "cni-conf-file", raccoonConf.DefaultCNIConfFile, "raccoon plugin configuration used to generate the conflist")
+	flag.StringVar(&d.cniConfDir, "cni-conf-dir", raccoonConf.DefaultCNIConfDir, "directory the conflist is written to")
+	flag.BoolVar(&d.enablePortmap, "enable-portmap", false, "chain the portmap plugin after raccoon")
+	flag.BoolVar(&d.enableBandwidth, "enable-bandwidth", false, "chain the bandwidth plugin after raccoon")
+	flag.StringVar(&d.networksFile, "networks-file", "", "json file with additional networks, each with its own subnet and bridge")
+	flag.StringVar(&d.backend, "backend", backend.NameHostGW, "how pod traffic reaches other nodes, host-gw, vxlan, ipip or geneve")
+	flag.IntVar(&d.vxlanVNI, "vxlan-vni", 1, "vni of the vxlan backend")
+	flag.IntVar(&d.vxlanPort, "vxlan-port", 4789, "udp port of the vxlan backend")
+	flag.IntVar(&d.geneveVNI, "geneve-vni", 1, "network-wide vni of the geneve backend")
+	flag.IntVar(&d.genevePort, "geneve-port", 6081, "udp port of the geneve backend")
+	flag.BoolVar(&d.crossSubnet, "cross-subnet", false, "route directly to peers on the host link subnet and use the backend only for the other peers")
+	flag.StringVar(&d.encryption, "encryption", "", "encrypt pod traffic between nodes, empty, wireguard or ipsec")
+	flag.IntVar(&d.wireguardPort, "wireguard-port", 51820, "udp port of the wireguard device")
+	flag.StringVar(&d.ipsecSecret, "ipsec-secret", "kube-system/raccoon-ipsec", "namespace/name of the secret with the ipsec pre-shared key in the psk key, the raccoon Role in deploy/raccoon.yaml only grants access to kube-system/raccoon-ipsec and must be changed to match")
+	flag.DurationVar(&d.ipsecRekey, "ipsec-rekey-interval", time.Hour, "interval after which ipsec keys are derived again")
+	flag.UintVar(&d.bgpAS, "bgp-as", 0, "local as of the bgp speaker")
+	flag.Func("bgp-peers", "comma-separated bgp peers as <ip>[:port]/<as>, enables the bgp speaker", func(s string) (err error) {
+		d.bgpPeers, err = bgp.ParsePeers(s)
+		return
+	})
+	flag.Func("bgp-service-cidrs", "comma-separated service cidrs advertised over bgp", func(s string) error {
+		for _, c := range strings.Split(s, ",") {
+			_, cidr, err := net.ParseCIDR(strings.TrimSpace(c))
+			if err != nil {
+				return err
+			}
+			d.bgpServiceCIDRs = append(d.bgpServiceCIDRs, cidr)
+		}
+		return nil
+	})
+	flag.BoolVar(&d.bgpAdvertiseLB, "bgp-advertise-lb", false, "advertise the ingress ips of loadbalancer services over bgp")
+	flag.BoolVar(&d.enableNetworkPolicy, "enable-network-policy", false, "enforce network policies on the host veths of local pods with iptables and ipsets")
+	flag.StringVar(&d.sysctlDir, "sysctl-dir", "/proc/sys", "directory the node sysctls are written to, e.g. the host /proc/sys mounted into the container")
 }
 
 func (d *DaemonConfig) parseConfig() error {
@@ -69,6 +207,45 @@ func (d *DaemonConfig) parseConfig() error {
 	if len(d.nodeName) == 0 {
 		return fmt.Errorf("node-name is required")
 	}
+
+	if !slices.Contains(backendNames, d.backend) {
+		return fmt.Errorf("unsupported backend %q", d.backend)
+	}
+
+	if d.crossSubnet && d.backend == backend.NameHostGW {
+		return fmt.Errorf("cross-subnet requires an overlay backend")
+	}
+
+	switch d.encryption {
+	case "":
+	case encryptionWireGuard, encryptionIPsec:
+		// WireGuard 设备自身完成节点之间的转发, IPsec policy 匹配容器子网之间的报文, 都不与隧道后端叠加
+		if d.backend != backend.NameHostGW {
+			return fmt.Errorf("%s encryption requires the host-gw backend", d.encryption)
+		}
+	default:
+		return fmt.Errorf("unsupported encryption %q", d.encryption)
+	}
+
+	if d.encryption == encryptionIPsec {
+		if namespace, name, ok := strings.Cut(d.ipsecSecret, "/"); !ok || namespace == "" || name == "" {
+			return fmt.Errorf("ipsec-secret must be namespace/name")
+		}
+		if d.ipsecRekey < time.Minute {
+			return fmt.Errorf("ipsec-rekey-interval must be at least 1m")
+		}
+	}
+
+	if len(d.bgpPeers) > 0 && (d.bgpAS == 0 || d.bgpAS > math.MaxUint32) {
+		return fmt.Errorf("bgp-as is required with bgp-peers")
+	}
+	if len(d.bgpPeers) == 0 && (len(d.bgpServiceCIDRs) > 0 || d.bgpAdvertiseLB) {
+		return fmt.Errorf("bgp-peers is required to advertise services")
+	}
+
+	if d.encapOverhead < -1 {
+		return fmt.Errorf("encap-overhead must not be negative")
+	}
 	return nil
 }
 
@@ -85,6 +262,11 @@ func main() {
 		log.Error(err, "failed to parse config")
 		os.Exit(1)
 	}
+
+	if err := RunController(&c); err != nil {
+		log.Error(err, "failed to run controller")
+		os.Exit(1)
+	}
 }
 
 func RunController(d *DaemonConfig) error {
@@ -94,13 +276,22 @@ func RunController(d *DaemonConfig) error {
 		return err
 	}
 
+	// 桥接的 Pod 的报文只有在 br_netfilter 加载后才经过 iptables, 否则网络策略不会生效
+	// 在 NewReconciler 设置节点 sysctl 之前加载, 节点注解记录的是加载后的值
+	if d.enableNetworkPolicy {
+		if err := enableBridgeNetfilter(d.sysctlDir); err != nil {
+			log.Error(err, "network policy requires br_netfilter")
+			return err
+		}
+	}
+
 	reconciler, err := NewReconciler(d, mgr)
 	if err != nil {
 		return err
 	}
 	log.Info("create reconciler success")
 
-	err = builder.
+	nodeController := builder.
 		ControllerManagedBy(mgr).
 		For(&corev1.Node{}).
 		WithEventFilter(predicate.Funcs{
@@ -113,18 +304,166 @@ func RunController(d *DaemonConfig) error {
 				if !ok {
 					return true
 				}
-				return old.Spec.PodCIDR != new.Spec.PodCIDR
+				return nodeChanged(old, new)
 			},
-		}).
-		Complete(reconciler)
+		})
+	// 跨子网模式根据宿主机网卡的地址选择直接路由或者后端, 地址变化时重新调谐
+	if d.crossSubnet {
+		addrEvents := make(chan event.GenericEvent)
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			watchHostAddrs(ctx, reconciler.hostLink.Attrs().Index, d.nodeName, addrEvents)
+			return nil
+		})); err != nil {
+			return err
+		}
+		nodeController = nodeController.WatchesRawSource(source.Channel(addrEvents, &handler.EnqueueRequestForObject{}))
+	}
+	err = nodeController.Complete(reconciler)
 	if err != nil {
 		log.Error(err, "could not create controller")
 		return err
 	}
 
+	// 存在租户网络时根据命名空间标签维护命名空间到租户网络的映射
+	if tenants := reconciler.tenants(); len(tenants) > 0 {
+		err = builder.
+			ControllerManagedBy(mgr).
+			For(&corev1.Namespace{}).
+			Complete(&TenantReconciler{client: mgr.GetClient(), tenants: tenants})
+		if err != nil {
+			log.Error(err, "could not create tenant controller")
+			return err
+		}
+	}
+
+	if len(d.bgpPeers) > 0 {
+		if err := setupBGP(d, mgr, reconciler); err != nil {
+			return err
+		}
+	}
+
+	if d.enableNetworkPolicy {
+		if err := setupNetworkPolicy(d, mgr, reconciler); err != nil {
+			return err
+		}
+	}
+
 	return mgr.Start(signals.SetupSignalHandler())
 }
 
+// watchHostAddrs 在宿主机网卡的地址变化时发送本节点的事件, 订阅失败或者中断时稍后重新订阅
+func watchHostAddrs(ctx context.Context, linkIndex int, nodeName string, events chan<- event.GenericEvent) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		updates := make(chan netlink.AddrUpdate, 16)
+		done := make(chan struct{})
+		defer close(done)
+
+		if err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+			ErrorCallback: func(err error) {
+				log.Error(err, "failed to receive address update")
+			},
+		}); err != nil {
+			log.Error(err, "failed to subscribe to address updates")
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case u, ok := <-updates:
+				if !ok {
+					return
+				}
+				if u.LinkIndex != linkIndex {
+					continue
+				}
+				log.Info("host link address changed", "address", u.LinkAddress.String(), "new", u.NewAddr)
+				select {
+				case events <- event.GenericEvent{Object: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}}}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}, 5*time.Second)
+}
+
+// setupBGP 创建 BGP 发言者, 通告本节点的子网和 Service 地址, 发言者随 manager 启动
+func setupBGP(d *DaemonConfig, mgr manager.Manager, r *Reconciler) error {
+	speaker := bgp.NewSpeaker(uint32(d.bgpAS), r.hostIP, r.hostIP, d.bgpPeers)
+
+	// 只通告默认网络和标记为 routable 的附加网络, nodeSubnets 的顺序与 r.networks 一致
+	subnets, err := r.nodeSubnets(r.nodeCIDR)
+	if err != nil {
+		return err
+	}
+	prefixes := []*net.IPNet{subnets[0]}
+	for i, n := range r.networks {
+		if n.Routable {
+			prefixes = append(prefixes, subnets[i+1])
+		}
+	}
+	speaker.SetRoutes(bgpGroupNode, prefixes)
+	speaker.SetRoutes(bgpGroupServices, d.bgpServiceCIDRs)
+
+	if err := mgr.Add(speaker); err != nil {
+		return err
+	}
+
+	if d.bgpAdvertiseLB {
+		err := builder.
+			ControllerManagedBy(mgr).
+			For(&corev1.Service{}).
+			Complete(&ServiceReconciler{client: mgr.GetClient(), speaker: speaker})
+		if err != nil {
+			log.Error(err, "could not create service controller")
+			return err
+		}
+	}
+
+	log.Info("setup bgp success", "as", d.bgpAS, "peers", len(d.bgpPeers), "prefixes", prefixes)
+	return nil
+}
+
+// setupNetworkPolicy 创建网络策略控制器, NetworkPolicy、Pod 和命名空间的变化都触发一次全量同步
+func setupNetworkPolicy(d *DaemonConfig, mgr manager.Manager, r *Reconciler) error {
+	enqueue := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: policyKey}}}
+	})
+	err := builder.
+		ControllerManagedBy(mgr).
+		Named(policyKey).
+		Watches(&networkingv1.NetworkPolicy{}, enqueue).
+		Watches(&corev1.Pod{}, enqueue, builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				old, ok := e.ObjectOld.(*corev1.Pod)
+				if !ok {
+					return true
+				}
+				new, ok := e.ObjectNew.(*corev1.Pod)
+				if !ok {
+					return true
+				}
+				return podChanged(old, new)
+			},
+		})).
+		Watches(&corev1.Namespace{}, enqueue, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Complete(&PolicyReconciler{
+			client:   mgr.GetClient(),
+			recorder: mgr.GetEventRecorderFor(appName),
+			nodeName: d.nodeName,
+			dataDir:  r.pluginConfig.DataDir,
+		})
+	if err != nil {
+		log.Error(err, "could not create network policy controller")
+		return err
+	}
+
+	log.Info("setup network policy success", "data dir", r.pluginConfig.DataDir)
+	return nil
+}
+
 func NewReconciler(d *DaemonConfig, mgr manager.Manager) (*Reconciler, error) {
 	_, cidr, err := net.ParseCIDR(d.clusterCIDR)
 	if err != nil {
@@ -148,191 +487,1637 @@ func NewReconciler(d *DaemonConfig, mgr manager.Manager) (*Reconciler, error) {
 
 	log.Info("get nodeinfo", "host ip", hostIP.String(), "node cidr", nodeCIDR.String())
 
-	subnetConf := &raccoonConf.SubnetConfig{
-		Subnet: nodeCIDR.String(),
-		Bridge: raccoonConf.DefaultBridgeName,
+	hostLink, err := bridge.LinkByIP(hostIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host link device: %v", err)
 	}
-	if err := raccoonConf.StoreSubnetConfig(subnetConf); err != nil {
+	log.Info(fmt.Sprintf("get hostlink success, type: %s, name: %s, index: %d", hostLink.Type(), hostLink.Attrs().Name, hostLink.Attrs().Index))
+
+	pluginData, err := os.ReadFile(d.cniConfFile)
+	if err != nil {
 		return nil, err
 	}
-
-	var hostLink netlink.Link
-	linkList, err := netlink.LinkList()
+	pluginConf, err := raccoonConf.LoadPluginConfig(pluginData)
 	if err != nil {
 		return nil, err
 	}
-Loop:
-	for _, link := range linkList {
-		if link.Attrs() != nil {
-			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
-			if err != nil {
-				return nil, err
-			}
-			for _, addr := range addrs {
-				if addr.IP.Equal(hostIP) {
-					hostLink = link
-					break Loop
-				}
-			}
-		}
+
+	// 已有的 Pod 保留创建时的 MTU, 在写入新的子网配置之前检查
+	if err := checkBackendSwitch(d.backend, node, hostLink.Attrs().MTU, pluginConf.MTU); err != nil {
+		return nil, err
 	}
-	if hostLink == nil {
-		return nil, fmt.Errorf("failed to get host link device")
+
+	// 根据宿主机网卡的 MTU 减去封装开销得到 Pod 的 MTU
+	overhead := d.encapOverhead
+	if overhead == -1 {
+		overhead = defaultOverhead(d, node)
 	}
-	log.Info(fmt.Sprintf("get hostlink success, type: %s, name: %s, index: %d", hostLink.Type(), hostLink.Attrs().Name, hostLink.Attrs().Index))
+	mtu := hostLink.Attrs().MTU - overhead
+	if mtu <= 0 {
+		return nil, fmt.Errorf("invalid mtu %d, host link mtu %d, encap overhead %d", mtu, hostLink.Attrs().MTU, overhead)
+	}
+	log.Info("detect mtu success", "host link mtu", hostLink.Attrs().MTU, "mtu", mtu)
 
-	_, err = bridge.CreateBridge(subnetConf.Bridge, 1500, net.IPNet{})
-	if err != nil {
+	subnetConf := &raccoonConf.SubnetConfig{
+		Network:  pluginConf.Name,
+		Subnet:   nodeCIDR.String(),
+		Bridge:   raccoonConf.DefaultBridgeName,
+		MTU:      mtu,
+		HostLink: hostLink.Attrs().Name,
+	}
+	if err := raccoonConf.StoreSubnetConfig(subnetConf); err != nil {
 		return nil, err
 	}
 
-	if d.enableIptables {
-		if err := addIptables(subnetConf.Bridge, hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
+	// ptp 模式下容器经由 veth 上的 /32 路由接入, 不需要网桥
+	routed := pluginConf.Mode == raccoonConf.ModePTP
+	if !routed {
+		_, err = bridge.CreateBridge(subnetConf.Bridge, subnetConf.MTU, net.IPNet{}, false)
+		if err != nil {
 			return nil, err
 		}
-		log.Info("set iptables success")
 	}
 
-	routes := make(map[string]netlink.Route)
-	routeList, err := netlink.RouteList(hostLink, netlink.FAMILY_V4)
-	if err != nil {
-		return nil, err
+	if err := installCNIConfig(d); err != nil {
+		return nil, fmt.Errorf("failed to install cni config: %v", err)
 	}
-	for _, route := range routeList {
-		if route.Dst != nil && !route.Dst.IP.Equal(nodeCIDR.IP) && cidr.Contains(route.Dst.IP) {
-			routes[route.Dst.String()] = route
+	log.Info("install cni config success", "dir", d.cniConfDir)
+
+	if d.enableIptables {
+		bridgeName := subnetConf.Bridge
+		if routed {
+			bridgeName = ""
+		}
+		if err := addIptables(bridgeName, hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
+			return nil, err
 		}
+		log.Info("set iptables success")
 	}
-	log.Info("get local routes", "routes", routes)
 
-	return &Reconciler{
+	r := &Reconciler{
 		client:       mgr.GetClient(),
+		reader:       mgr.GetAPIReader(),
 		clusterCIDR:  cidr,
 		hostLink:     hostLink,
-		routes:       routes,
+		hostIP:       hostIP,
+		nodeCIDR:     nodeCIDR,
 		config:       d,
+		pluginConfig: pluginConf,
 		subnetConfig: subnetConf,
-	}, nil
-}
+		wgPeers:      make(map[string]*backend.WireGuardPeer),
+	}
 
-func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
-	log.Info("start reconcile", "key", req.NamespacedName.Name)
-	result := reconcile.Result{}
-	nodes := &corev1.NodeList{}
-	if err := r.client.List(ctx, nodes); err != nil {
-		return result, err
+	// 节点信息记录在注解中, 供其他节点使用
+	annotations := make(map[string]string)
+	if err := r.setupBackends(node, annotations); err != nil {
+		return nil, err
 	}
 
-	cidrs := make(map[string]netlink.Route)
-	for _, node := range nodes.Items {
-		if node.Name == r.config.nodeName {
-			continue
+	if d.encryption == encryptionWireGuard {
+		if err := r.setupWireGuard(node, annotations); err != nil {
+			return nil, fmt.Errorf("failed to setup wireguard: %v", err)
 		}
+		log.Info("setup wireguard success", "port", d.wireguardPort, "mtu", mtu)
+	}
 
-		if len(node.Spec.PodCIDR) == 0 {
-			continue
+	if d.encryption == encryptionIPsec {
+		if err := r.setupIPsec(annotations); err != nil {
+			return nil, fmt.Errorf("failed to setup ipsec: %v", err)
 		}
+		log.Info("setup ipsec success", "states", len(r.xfrmStates), "policies", len(r.xfrmPolicies))
+	}
+
+	if err := r.setupNetworks(mgr.GetAPIReader(), nodeCIDR); err != nil {
+		return nil, fmt.Errorf("failed to setup networks: %v", err)
+	}
+
+	// 本节点的子网不需要路由
+	localSubnets, err := r.nodeSubnets(nodeCIDR)
+	if err != nil {
+		return nil, err
+	}
 
-		_, cidr, err := net.ParseCIDR(node.Spec.PodCIDR)
+	routes := make(map[string]netlink.Route)
+	links := []netlink.Link{hostLink}
+	for _, b := range r.backends {
+		backendLinks, err := b.Links()
 		if err != nil {
-			return result, err
+			return nil, err
+		}
+		links = append(links, backendLinks...)
+	}
+	if r.wireguard != nil {
+		links = append(links, r.wireguard)
+	}
+	for _, br := range r.vlanBridges {
+		links = append(links, br)
+	}
+	for _, link := range links {
+		routeList, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routeList {
+			if route.Dst != nil && !containsSubnet(localSubnets, route.Dst) && r.isManagedSubnet(route.Dst) {
+				routes[routeKey(route)] = route
+			}
+		}
+	}
+	// 租户网络到其他节点的路由在 VRF 的路由表中
+	for _, n := range r.networks {
+		if !n.Tenant {
+			continue
+		}
+		routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: n.Table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routeList {
+			// WireGuard 设备上的路由没有网关
+			peer := route.Gw != nil || (r.wireguard != nil && route.LinkIndex == r.wireguard.Attrs().Index)
+			if route.Dst != nil && peer && !containsSubnet(localSubnets, route.Dst) {
+				routes[routeKey(route)] = route
+			}
 		}
+	}
+	log.Info("get local routes", "routes", routes)
+	r.routes = routes
 
-		nodeip, err := getNodeInternalIP(&node)
+	// 节点级别的 sysctl 在网络配置完成后检查, flat 网络会开启宿主机网卡的 proxy ARP
+	sysctls, err := enforceSysctls(d.sysctlDir, hostLink.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(sysctls)
+	if err != nil {
+		return nil, err
+	}
+	annotations[sysctlsAnnotation] = string(data)
+
+	if err := r.annotateNode(node, annotations); err != nil {
+		return nil, fmt.Errorf("failed to annotate node: %v", err)
+	}
+
+	return r, nil
+}
+
+// setupNetworks 为每个附加网络写入子网配置、创建网桥并设置 iptables 规则
+func (r *Reconciler) setupNetworks(reader client.Reader, nodeCIDR *net.IPNet) error {
+	if r.config.networksFile != "" {
+		networks, err := raccoonConf.LoadNetworkConfigs(r.config.networksFile)
 		if err != nil {
-			log.Error(err, "failed to get host")
+			return err
+		}
+		r.networks = networks
+	}
+
+	r.vlanBridges = make(map[string]netlink.Link)
+	bridges := []string{r.subnetConfig.Bridge}
+	var isolated []string
+	for _, n := range r.networks {
+		if n.Flat {
+			if err := r.setupFlatNetwork(reader, n); err != nil {
+				return fmt.Errorf("failed to setup flat network %s: %v", n.Name, err)
+			}
 			continue
 		}
-		route := netlink.Route{
-			Dst:        cidr,
-			Gw:         nodeip,
-			ILinkIndex: r.hostLink.Attrs().Index,
+
+		_, networkCIDR, _ := net.ParseCIDR(n.CIDR)
+		subnet, err := raccoonConf.NodeSubnet(r.clusterCIDR, nodeCIDR, networkCIDR)
+		if err != nil {
+			return fmt.Errorf("failed to get subnet of network %s: %v", n.Name, err)
+		}
+
+		subnetConf := &raccoonConf.SubnetConfig{
+			Subnet:   subnet.String(),
+			Bridge:   n.Bridge,
+			MTU:      r.subnetConfig.MTU,
+			HostLink: r.subnetConfig.HostLink,
+			Routes:   n.Routes,
+			VLAN:     n.VLAN,
+		}
+		if err := raccoonConf.StoreNetworkSubnetConfig(n.Name, subnetConf); err != nil {
+			return err
 		}
-		cidrs[cidr.String()] = route
 
-		if currentRoute, ok := r.routes[cidr.String()]; ok {
-			if isRouteEqual(route, currentRoute) {
-				continue
+		br, err := bridge.CreateBridge(n.Bridge, subnetConf.MTU, net.IPNet{}, false)
+		if err != nil {
+			return err
+		}
+
+		// VLAN 网络的网桥通过宿主机网卡上的 VLAN 子接口接入物理网络
+		if n.VLAN != 0 {
+			if err := bridge.SetupBridgeVlan(br, n.VLAN); err != nil {
+				return err
 			}
-			if err := r.ReplaceRoute(currentRoute); err != nil {
-				return result, err
+			uplink, err := bridge.SetupVlanUplink(r.hostLink, br, n.VLAN, subnetConf.MTU)
+			if err != nil {
+				return fmt.Errorf("failed to setup vlan uplink of network %s: %v", n.Name, err)
 			}
-		} else {
-			if err := r.addRoute(route); err != nil {
-				return result, err
+			r.vlanBridges[n.Name] = br
+			log.Info("setup vlan uplink success", "network", n.Name, "vlan", n.VLAN, "uplink", uplink.Attrs().Name)
+		}
+
+		// 租户网络的网桥接入 VRF, 与其他网络使用不同的路由表
+		if n.Tenant {
+			if err := setupTenant(n, br, subnet); err != nil {
+				return fmt.Errorf("failed to setup tenant network %s: %v", n.Name, err)
 			}
+			log.Info("setup vrf success", "network", n.Name, "vrf", n.VRF, "table", n.Table)
 		}
-	}
 
-	for cidr, route := range r.routes {
-		if _, ok := cidrs[cidr]; !ok {
-			if err := r.delRoute(route); err != nil {
-				return result, err
+		if r.config.enableIptables {
+			if err := addIptables(n.Bridge, r.hostLink.Attrs().Name, subnetConf.Subnet); err != nil {
+				return err
 			}
 		}
+
+		bridges = append(bridges, n.Bridge)
+		if n.Isolated || n.Tenant {
+			isolated = append(isolated, n.Bridge)
+		}
+		log.Info("setup network success", "network", n.Name, "subnet", subnetConf.Subnet, "bridge", n.Bridge, "isolated", n.Isolated)
 	}
 
-	return result, nil
-}
+	if err := raccoonConf.PruneNetworkSubnetConfigs(r.networks); err != nil {
+		return err
+	}
 
-func (r *Reconciler) addRoute(route netlink.Route) (err error) {
-	defer func() {
-		if err == nil {
-			r.routes[route.Dst.String()] = route
+	// 没有租户网络时清空映射, 避免插件使用已经删除的租户网络
+	if len(r.tenants()) == 0 {
+		if err := raccoonConf.StoreTenants(map[string]string{}); err != nil {
+			return err
 		}
-	}()
-
-	log.Info(fmt.Sprintf("add route: %s", route.String()))
-	err = netlink.RouteAdd(&route)
-	if err != nil {
-		log.Error(err, "failed to add route", "route", route.String())
 	}
-	return
+
+	return setupIsolation(bridges, isolated)
 }
 
-func (r *Reconciler) delRoute(route netlink.Route) (err error) {
-	defer func() {
-		if err == nil {
-			delete(r.routes, route.Dst.String())
+// nodeSubnets 返回节点在默认网络和所有附加网络中的子网, 依次对应 r.networks
+// flat 网络的地址块在宿主机子网中, 不需要路由, 对应的子网为空
+func (r *Reconciler) nodeSubnets(podCIDR *net.IPNet) ([]*net.IPNet, error) {
+	subnets := []*net.IPNet{podCIDR}
+	for _, n := range r.networks {
+		if n.Flat {
+			subnets = append(subnets, nil)
+			continue
 		}
-	}()
-	log.Info(fmt.Sprintf("del route: %s", route.String()))
-	err = netlink.RouteDel(&route)
-	return
-}
 
-func (r *Reconciler) ReplaceRoute(route netlink.Route) (err error) {
-	defer func() {
-		if err == nil {
-			r.routes[route.Dst.String()] = route
+		_, networkCIDR, _ := net.ParseCIDR(n.CIDR)
+		subnet, err := raccoonConf.NodeSubnet(r.clusterCIDR, podCIDR, networkCIDR)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	log.Info(fmt.Sprintf("replace route: %s", route.String()))
-	err = netlink.RouteReplace(&route)
-	return
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
 }
 
-func addIptables(bridgeName, hostDeviceName, nodeCIDR string) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+// setupFlatNetwork 认领 flat 网络的地址块并写入子网配置, 在宿主机网卡上开启 proxy ARP 代替容器应答
+func (r *Reconciler) setupFlatNetwork(reader client.Reader, n raccoonConf.NetworkConfig) error {
+	_, cidr, _ := net.ParseCIDR(n.CIDR)
+
+	// 地址块必须在宿主机网卡的子网中, 其他机器才会直接通过 ARP 访问容器
+	addrs, err := netlink.AddrList(r.hostLink, netlink.FAMILY_V4)
 	if err != nil {
 		return err
 	}
+	onLink := false
+	for _, addr := range addrs {
+		addrOnes, _ := addr.Mask.Size()
+		cidrOnes, _ := cidr.Mask.Size()
+		if addr.IPNet.Contains(cidr.IP) && cidrOnes >= addrOnes {
+			onLink = true
+			break
+		}
+	}
+	if !onLink {
+		return fmt.Errorf("cidr %s is not in the subnet of host link %s", cidr, r.hostLink.Attrs().Name)
+	}
 
-	if err := ipt.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-j", "ACCEPT"); err != nil {
+	// 宿主机网卡的地址和网关不能分配给容器
+	var reserved []net.IP
+	for _, addr := range addrs {
+		reserved = append(reserved, addr.IP)
+	}
+	if _, gateway, err := bridge.UnderlayNetwork(r.hostLink.Attrs().Name); err != nil {
 		return err
+	} else if gateway != nil {
+		reserved = append(reserved, gateway)
 	}
 
-	if err := ipt.AppendUnique("filter", "FORWARD", "-i", hostDeviceName, "-j", "ACCEPT"); err != nil {
+	block, err := r.claimFlatBlock(context.TODO(), reader, n, reserved)
+	if err != nil {
 		return err
 	}
 
-	if err := ipt.AppendUnique("nat", "POSTROUTING", "-s", nodeCIDR, "-j", "MASQUERADE"); err != nil {
+	// 容器流量不经过封装, 使用宿主机网卡的 MTU
+	subnetConf := &raccoonConf.SubnetConfig{
+		Subnet:   block.String(),
+		MTU:      r.hostLink.Attrs().MTU,
+		HostLink: r.hostLink.Attrs().Name,
+		Routes:   n.Routes,
+	}
+	if err := raccoonConf.StoreNetworkSubnetConfig(n.Name, subnetConf); err != nil {
+		return err
+	}
+
+	if _, err := nodeSysctl(r.config.sysctlDir, fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", r.hostLink.Attrs().Name), "1"); err != nil {
+		return fmt.Errorf("failed to enable proxy arp on %q: %v", r.hostLink.Attrs().Name, err)
+	}
+
+	if r.config.enableIptables {
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique("filter", "FORWARD", "-s", block.String(), "-j", "ACCEPT"); err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique("filter", "FORWARD", "-d", block.String(), "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+
+	log.Info("setup flat network success", "network", n.Name, "block", block.String())
+	return nil
+}
+
+// claimFlatBlock 在节点注解中认领 flat 网络的地址块, 已经认领过时继续使用
+// 写入注解后等待一段时间重新读取, 其他节点认领了同一个地址块时两个节点都放弃该地址块, 随机退避后重新认领
+// 包含 reserved 中的地址或者任一节点 InternalIP 的地址块不会被认领
+func (r *Reconciler) claimFlatBlock(ctx context.Context, reader client.Reader, n raccoonConf.NetworkConfig, reserved []net.IP) (*net.IPNet, error) {
+	_, cidr, _ := net.ParseCIDR(n.CIDR)
+	blocks, err := raccoonConf.FlatBlocks(cidr, n.Block)
+	if err != nil {
+		return nil, err
+	}
+	key := raccoonConf.FlatBlockAnnotationPrefix + n.Name
+
+	for i := 0; ; i++ {
+		nodes := &corev1.NodeList{}
+		if err := reader.List(ctx, nodes); err != nil {
+			return nil, err
+		}
+
+		var self *corev1.Node
+		used := make(map[string]bool)
+		excluded := append([]net.IP(nil), reserved...)
+		for j := range nodes.Items {
+			node := &nodes.Items[j]
+			if ip, err := getNodeInternalIP(node); err == nil {
+				excluded = append(excluded, ip)
+			}
+			if node.Name == r.config.nodeName {
+				self = node
+				continue
+			}
+			if block, ok := node.Annotations[key]; ok {
+				used[block] = true
+			}
+		}
+		if self == nil {
+			return nil, fmt.Errorf("node %s not found", r.config.nodeName)
+		}
+
+		var free *net.IPNet
+		claimed := self.Annotations[key]
+		for _, block := range blocks {
+			if used[block.String()] || containsAnyIP(block, excluded) {
+				continue
+			}
+			// 重新读取后没有冲突, 认领成功
+			if block.String() == claimed {
+				return block, nil
+			}
+			if free == nil {
+				free = block
+			}
+		}
+
+		if i == flatClaimRetries {
+			return nil, fmt.Errorf("failed to claim a block in %s after %d retries", cidr, flatClaimRetries)
+		}
+		if claimed != "" {
+			log.Info("flat block conflicts with another node or a reserved address, claim again", "network", n.Name, "block", claimed)
+			time.Sleep(wait.Jitter(flatClaimBackoff, 1))
+		}
+		if free == nil {
+			return nil, fmt.Errorf("no free block in %s", cidr)
+		}
+
+		patch := client.MergeFrom(self.DeepCopy())
+		if self.Annotations == nil {
+			self.Annotations = make(map[string]string)
+		}
+		self.Annotations[key] = free.String()
+		if err := r.client.Patch(ctx, self, patch); err != nil {
+			return nil, err
+		}
+		log.Info("claim flat block", "network", n.Name, "block", free.String())
+
+		// 等待同时认领的节点写入注解后重新检查
+		time.Sleep(wait.Jitter(flatClaimBackoff, 1))
+	}
+}
+
+// annotateNode 在本节点上添加注解
+func (r *Reconciler) annotateNode(node *corev1.Node, annotations map[string]string) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	for k, v := range annotations {
+		node.Annotations[k] = v
+	}
+
+	return r.client.Patch(context.TODO(), node, patch)
+}
+
+// tenants 返回所有租户网络的名称
+func (r *Reconciler) tenants() map[string]bool {
+	tenants := make(map[string]bool)
+	for _, n := range r.networks {
+		if n.Tenant {
+			tenants[n.Name] = true
+		}
+	}
+
+	return tenants
+}
+
+// isManagedSubnet 判断子网是否属于集群网段或者附加网络
+func (r *Reconciler) isManagedSubnet(subnet *net.IPNet) bool {
+	if r.clusterCIDR.Contains(subnet.IP) {
+		return true
+	}
+
+	for _, n := range r.networks {
+		if n.Flat {
+			continue
+		}
+		if _, networkCIDR, _ := net.ParseCIDR(n.CIDR); networkCIDR.Contains(subnet.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	log.Info("start reconcile", "key", req.NamespacedName.Name)
+	result := reconcile.Result{}
+	nodes := &corev1.NodeList{}
+	if err := r.client.List(ctx, nodes); err != nil {
+		return result, err
+	}
+
+	cidrs := make(map[string]netlink.Route)
+	// 宿主机网卡的地址可能变化, 每次调谐时重新获取
+	var hostSubnets []*net.IPNet
+	if r.config.crossSubnet {
+		addrs, err := netlink.AddrList(r.hostLink, netlink.FAMILY_V4)
+		if err != nil {
+			return result, err
+		}
+		for _, addr := range addrs {
+			hostSubnets = append(hostSubnets, &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+		}
+	}
+
+	// IPsec 的密钥按周期派生, 每个周期开始时重新调谐
+	var psk []byte
+	var epoch int64
+	var localSubnets []*net.IPNet
+	if r.config.encryption == encryptionIPsec {
+		var err error
+		if psk, err = r.ipsecPSK(ctx); err != nil {
+			return result, err
+		}
+		now := time.Now()
+		epoch = now.Unix() / int64(r.config.ipsecRekey.Seconds())
+		result.RequeueAfter = time.Unix((epoch+1)*int64(r.config.ipsecRekey.Seconds()), 0).Sub(now) + time.Second
+
+		subnets, err := r.nodeSubnets(r.nodeCIDR)
+		if err != nil {
+			return result, err
+		}
+		localSubnets = r.encryptedSubnets(subnets)
+	}
+
+	inUse := r.switchBackend(nodes)
+
+	seen := make(map[string]map[string]bool)
+	for name := range r.backends {
+		seen[name] = make(map[string]bool)
+	}
+	wgPeers := make(map[string]*backend.WireGuardPeer)
+	xfrmStates := make(map[string]netlink.XfrmState)
+	xfrmPolicies := make(map[string]netlink.XfrmPolicy)
+	for _, node := range nodes.Items {
+		if node.Name == r.config.nodeName {
+			if r.config.encryption == encryptionWireGuard {
+				if err := r.rotateWireGuardKey(node.DeepCopy()); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+
+		if len(node.Spec.PodCIDR) == 0 {
+			continue
+		}
+
+		_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+		if err != nil {
+			return result, err
+		}
+
+		nodeip, err := getNodeInternalIP(&node)
+		if err != nil {
+			log.Error(err, "failed to get host")
+			continue
+		}
+
+		peer := &backend.Peer{Name: node.Name, IP: nodeip, PodCIDR: podCIDR, Annotations: node.Annotations}
+
+		// 切换期间其他后端也建立到对端节点的状态, 仍然使用其他后端发送的对端节点可以访问本节点
+		for name, b := range r.backends {
+			if name == r.active {
+				continue
+			}
+			if _, err := r.setupPeer(b, peer, seen); err != nil {
+				return result, err
+			}
+		}
+
+		// 与对端节点在同一个子网时直接路由, 不经过隧道
+		var nexthop *backend.Nexthop
+		if containsIP(hostSubnets, nodeip) {
+			nexthop, err = r.hostGW.SetupPeer(peer)
+		} else {
+			nexthop, err = r.setupPeer(r.backends[r.active], peer, seen)
+		}
+		if err != nil {
+			return result, err
+		}
+		// 对端节点还没有发布后端需要的信息时暂不添加路由
+		if nexthop == nil {
+			continue
+		}
+
+		// 节点在默认网络和每个附加网络中的子网都经由节点的 InternalIP
+		subnets, err := r.nodeSubnets(podCIDR)
+		if err != nil {
+			return result, err
+		}
+
+		// WireGuard 需要对端的公钥和地址, 对端还没有写入注解时暂不添加路由
+		if r.config.encryption == encryptionWireGuard {
+			peer := r.wireGuardPeer(&node, subnets)
+			if peer == nil {
+				continue
+			}
+			wgPeers[node.Name] = peer
+		}
+
+		// IPsec 的接收端密钥由对端的 boot_id 派生, 对端还没有写入注解时暂不添加路由
+		if r.config.encryption == encryptionIPsec {
+			bootID := node.Annotations[backend.IPsecBootIDAnnotation]
+			if bootID == "" {
+				log.Info("wait for ipsec boot id", "node", node.Name)
+				continue
+			}
+			// 发送使用当前周期的密钥, 接收接受相邻周期的密钥, 容忍节点之间的时钟偏差
+			out := backend.IPsecState(psk, r.hostIP, nodeip, epoch, r.bootID)
+			xfrmStates[xfrmStateKey(out)] = *out
+			for e := epoch - 1; e <= epoch+1; e++ {
+				in := backend.IPsecState(psk, nodeip, r.hostIP, e, bootID)
+				xfrmStates[xfrmStateKey(in)] = *in
+			}
+			for _, p := range backend.IPsecPolicies(r.hostIP, nodeip, localSubnets, r.encryptedSubnets(subnets)) {
+				xfrmPolicies[xfrmPolicyKey(&p)] = p
+			}
+		}
+
+		for i, cidr := range subnets {
+			if cidr == nil {
+				continue
+			}
+
+			route := r.peerRoute(i, cidr, nexthop)
+			cidrs[routeKey(route)] = route
+
+			if currentRoute, ok := r.routes[routeKey(route)]; ok {
+				if isRouteEqual(route, currentRoute) {
+					continue
+				}
+				if err := r.ReplaceRoute(route); err != nil {
+					return result, err
+				}
+			} else {
+				if err := r.addRoute(route); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+
+	for key, route := range r.routes {
+		if _, ok := cidrs[key]; !ok {
+			if err := r.delRoute(route); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if err := r.teardownPeers(seen); err != nil {
+		return result, err
+	}
+
+	if err := r.closeBackends(inUse); err != nil {
+		return result, err
+	}
+
+	if err := r.syncWireGuardPeers(wgPeers); err != nil {
+		return result, err
+	}
+
+	if err := r.syncIPsec(xfrmStates, xfrmPolicies, epoch); err != nil {
+		return result, err
+	}
+
+	if err := r.publishBackends(nodes); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// peerRoute 返回到对端节点子网 cidr 的路由, i 为 0 时是默认网络, 否则是 r.networks[i-1]
+// nexthop 是后端返回的到对端节点的下一跳
+func (r *Reconciler) peerRoute(i int, cidr *net.IPNet, nexthop *backend.Nexthop) netlink.Route {
+	route := netlink.Route{
+		Dst:       cidr,
+		Gw:        nexthop.Gw,
+		LinkIndex: nexthop.LinkIndex,
+		Encap:     nexthop.Encap,
+	}
+	if nexthop.Onlink {
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+
+	// WireGuard 设备根据对端的 AllowedIPs 选择对端, 路由不需要网关
+	if r.wireguard != nil {
+		route.Gw = nil
+		route.Flags = 0
+		route.Encap = nil
+		route.LinkIndex = r.wireguard.Attrs().Index
+		route.Scope = netlink.SCOPE_LINK
+	}
+
+	if i == 0 {
+		return route
+	}
+
+	n := r.networks[i-1]
+	// VLAN 网络中各节点的网桥处于同一个二层网络, 直接经由对端网桥上的网关
+	if br, ok := r.vlanBridges[n.Name]; ok {
+		route.Gw = ip.NextIP(cidr.IP)
+		route.LinkIndex = br.Attrs().Index
+		route.Flags = int(netlink.FLAG_ONLINK)
+		route.Encap = nil
+	}
+	// 租户网络的路由添加到 VRF 的路由表中, 网关不在 VRF 的直连网段中
+	if n.Tenant {
+		route.Table = n.Table
+		if route.Gw != nil {
+			route.Flags = int(netlink.FLAG_ONLINK)
+		}
+	}
+
+	return route
+}
+
+// Reconcile 重新收集所有 LoadBalancer 类型 Service 的 IPv4 地址, 以 /32 通告
+func (s *ServiceReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	services := &corev1.ServiceList{}
+	if err := s.client.List(ctx, services); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	var prefixes []*net.IPNet
+	for _, svc := range services.Items {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(ingress.IP).To4(); ip != nil {
+				prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+			}
+		}
+	}
+	s.speaker.SetRoutes(bgpGroupLoadBalancers, prefixes)
+
+	return reconcile.Result{}, nil
+}
+
+// Reconcile 重新编译所有 NetworkPolicy, 只为本节点经由 veth 接入的 Pod 生成规则
+func (p *PolicyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	policies := &networkingv1.NetworkPolicyList{}
+	if err := p.client.List(ctx, policies); err != nil {
+		return reconcile.Result{}, err
+	}
+	pods := &corev1.PodList{}
+	if err := p.client.List(ctx, pods); err != nil {
+		return reconcile.Result{}, err
+	}
+	namespaces := &corev1.NamespaceList{}
+	if err := p.client.List(ctx, namespaces); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	veths, err := p.hostVeths()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// 存储中没有记录 veth 的 Pod 在插件记录 veth 之前创建, 被策略选中时根据路由和邻居表查找
+	// macvlan 和 ipvlan 模式的 Pod 没有宿主机端 veth, 被策略选中时记录事件, 不受网络策略限制
+	var local []policy.LocalPod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != p.nodeName {
+			continue
+		}
+		ip := policy.PodIP(pod)
+		if ip == nil {
+			continue
+		}
+		veth, ok := veths[ip.String()]
+		if !ok {
+			if !policy.Selected(policies.Items, pod) {
+				continue
+			}
+			if veth, err = bridge.HostVethByIP(ip); err != nil {
+				log.Info("network policy not enforced", "pod", pod.Namespace+"/"+pod.Name, "ip", ip.String(), "reason", err.Error())
+				p.recorder.Eventf(pod, corev1.EventTypeWarning, "NetworkPolicyNotEnforced", "no host veth found for %s: %v", ip, err)
+				continue
+			}
+		}
+		local = append(local, policy.LocalPod{Pod: pod, IP: ip, HostVeth: veth})
+	}
+
+	rs := policy.Compile(policies.Items, pods.Items, namespaces.Items, local)
+	if err := rs.Apply(); err != nil {
+		return reconcile.Result{}, err
+	}
+	log.Info("sync network policies success", "policies", len(policies.Items), "local pods", len(local), "chains", len(rs.Chains), "sets", len(rs.Sets))
+
+	return reconcile.Result{}, nil
+}
+
+// hostVeths 从默认网络、附加网络和租户网络的存储中读取 Pod 地址对应的宿主机端 veth
+// 每次同步时重新列出存储, 之后添加的网络也会被包含
+func (p *PolicyReconciler) hostVeths() (map[string]string, error) {
+	networks, err := store.Networks(p.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	veths := make(map[string]string)
+	for _, n := range networks {
+		s, err := store.NewStore(p.dataDir, n)
+		if err != nil {
+			return nil, err
+		}
+		v, err := ipam.LookupHostVeths(s)
+		s.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup host veths of network %s: %v", n, err)
+		}
+		for ip, veth := range v {
+			veths[ip] = veth
+		}
+	}
+
+	return veths, nil
+}
+
+// Reconcile 重新生成命名空间到租户网络的映射, 标签指向不存在的租户网络时忽略
+func (t *TenantReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	namespaces := &corev1.NamespaceList{}
+	if err := t.client.List(ctx, namespaces); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	mapping := make(map[string]string)
+	for _, ns := range namespaces.Items {
+		network, ok := ns.Labels[raccoonConf.TenantLabel]
+		if !ok {
+			continue
+		}
+		if !t.tenants[network] {
+			log.Info("ignore unknown tenant network", "namespace", ns.Name, "network", network)
+			continue
+		}
+		mapping[ns.Name] = network
+	}
+
+	if err := raccoonConf.StoreTenants(mapping); err != nil {
+		return reconcile.Result{}, err
+	}
+	log.Info("update tenants success", "key", req.NamespacedName.Name, "tenants", mapping)
+
+	return reconcile.Result{}, nil
+}
+
+func (r *Reconciler) addRoute(route netlink.Route) (err error) {
+	defer func() {
+		if err == nil {
+			r.routes[routeKey(route)] = route
+		}
+	}()
+
+	log.Info(fmt.Sprintf("add route: %s", route.String()))
+	err = netlink.RouteAdd(&route)
+	if err != nil {
+		log.Error(err, "failed to add route", "route", route.String())
+	}
+	return
+}
+
+func (r *Reconciler) delRoute(route netlink.Route) (err error) {
+	defer func() {
+		if err == nil {
+			delete(r.routes, routeKey(route))
+		}
+	}()
+	log.Info(fmt.Sprintf("del route: %s", route.String()))
+	err = netlink.RouteDel(&route)
+	return
+}
+
+func (r *Reconciler) ReplaceRoute(route netlink.Route) (err error) {
+	defer func() {
+		if err == nil {
+			r.routes[routeKey(route)] = route
+		}
+	}()
+	log.Info(fmt.Sprintf("replace route: %s", route.String()))
+	err = netlink.RouteReplace(&route)
+	return
+}
+
+// installCNIConfig 根据插件配置生成 conflist 并写入CNI配置目录
+func installCNIConfig(d *DaemonConfig) error {
+	pluginConf, err := os.ReadFile(d.cniConfFile)
+	if err != nil {
+		return err
+	}
+
+	confList, err := raccoonConf.GenerateConfList(pluginConf, d.enablePortmap, d.enableBandwidth)
+	if err != nil {
+		return err
+	}
+
+	return raccoonConf.StoreConfList(d.cniConfDir, confList)
+}
+
+// addIptables 允许容器流量的转发并为其添加 SNAT, bridgeName 为空时容器经由各自的 veth 路由, 按容器子网匹配
+func addIptables(bridgeName, hostDeviceName, nodeCIDR string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	pod := []string{"-i", bridgeName}
+	if bridgeName == "" {
+		pod = []string{"-s", nodeCIDR}
+	}
+	if err := ipt.AppendUnique("filter", "FORWARD", append(pod, "-j", "ACCEPT")...); err != nil {
+		return err
+	}
+
+	if err := ipt.AppendUnique("filter", "FORWARD", "-i", hostDeviceName, "-j", "ACCEPT"); err != nil {
+		return err
+	}
+
+	if err := ipt.AppendUnique("nat", "POSTROUTING", "-s", nodeCIDR, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setupIsolation 禁止隔离网络的网桥与其他网桥之间的转发
+func setupIsolation(bridges, isolated []string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	// 使用单独的链, 每次启动时重新生成规则, 没有隔离网络时也要清空, 删除已经移除的隔离网络的规则
+	if err := ipt.ClearChain("filter", isolationChain); err != nil {
+		return err
+	}
+	if len(isolated) == 0 {
+		return nil
+	}
+
+	for _, b := range isolated {
+		for _, other := range bridges {
+			if other == b {
+				continue
+			}
+			if err := ipt.AppendUnique("filter", isolationChain, "-i", b, "-o", other, "-j", "DROP"); err != nil {
+				return err
+			}
+			if err := ipt.AppendUnique("filter", isolationChain, "-i", other, "-o", b, "-j", "DROP"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 隔离规则需要在 addIptables 添加的 ACCEPT 规则之前
+	exists, err := ipt.Exists("filter", "FORWARD", "-j", isolationChain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ipt.Insert("filter", "FORWARD", 1, "-j", isolationChain)
+	}
+
+	return nil
+}
+
+// setupTenant 创建租户网络的 VRF 并将网桥接入, 在主路由表中添加到本节点租户子网的路由, 使其他节点的流量可以进入 VRF
+func setupTenant(n raccoonConf.NetworkConfig, br netlink.Link, subnet *net.IPNet) error {
+	vrf, err := bridge.CreateVRF(n.VRF, n.Table)
+	if err != nil {
+		return err
+	}
+
+	if err := bridge.SetVRF(br, vrf); err != nil {
+		return err
+	}
+
+	return netlink.RouteReplace(&netlink.Route{
+		Dst:       subnet,
+		LinkIndex: br.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+	})
+}
+
+// enforceSysctls 设置 raccoond 需要的节点 sysctl, 并返回这些 sysctl 以及宿主机网卡 proxy_arp 的当前值
+// bridge-nf-call-iptables 需要加载 br_netfilter 模块, 设置失败时只记录错误
+func enforceSysctls(dir, hostLink string) (map[string]string, error) {
+	// 网卡名称中可能包含 ".", 例如 VLAN 子接口, 因此直接使用 /proc/sys 下的路径
+	required := []struct {
+		path, value string
+		optional    bool
+	}{
+		{"net/ipv4/ip_forward", "1", false},
+		{"net/bridge/bridge-nf-call-iptables", "1", true},
+		// 宽松模式, 经由 VRF、ptp 和 flat 网络的报文可能从不同的网卡返回
+		{fmt.Sprintf("net/ipv4/conf/%s/rp_filter", hostLink), "2", false},
+	}
+
+	sysctls := make(map[string]string)
+	for _, s := range required {
+		if _, err := nodeSysctl(dir, s.path, s.value); err != nil {
+			if !s.optional {
+				return nil, fmt.Errorf("failed to set sysctl %s=%s: %v", s.path, s.value, err)
+			}
+			log.Error(err, "failed to set sysctl", "path", s.path, "value", s.value)
+			sysctls[s.path] = "unavailable"
+			continue
+		}
+		sysctls[s.path] = s.value
+	}
+
+	proxyARP := fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", hostLink)
+	value, err := nodeSysctl(dir, proxyARP)
+	if err != nil {
+		return nil, err
+	}
+	sysctls[proxyARP] = value
+
+	log.Info("enforce sysctls success", "sysctls", sysctls)
+	return sysctls, nil
+}
+
+// enableBridgeNetfilter 加载 br_netfilter 模块并开启 bridge-nf-call-iptables, 失败时返回错误
+func enableBridgeNetfilter(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "net/bridge")); os.IsNotExist(err) {
+		if out, err := exec.Command("modprobe", "br_netfilter").CombinedOutput(); err != nil {
+			return fmt.Errorf("modprobe br_netfilter failed: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if _, err := nodeSysctl(dir, "net/bridge/bridge-nf-call-iptables", "1"); err != nil {
+		return fmt.Errorf("failed to set sysctl net/bridge/bridge-nf-call-iptables=1: %v", err)
+	}
+
+	log.Info("enable br_netfilter success")
+	return nil
+}
+
+// nodeSysctl 读取 dir 下的节点 sysctl, 指定 value 时先写入
+// dir 可以是挂载到容器中的宿主机 /proc/sys, raccoond 不需要以特权模式运行
+func nodeSysctl(dir, name string, value ...string) (string, error) {
+	path := filepath.Join(dir, name)
+	if len(value) > 0 {
+		if err := os.WriteFile(path, []byte(value[0]), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// routeKey 返回路由在 routes 中的键, 不同路由表中的路由可以有相同的目的网段
+func routeKey(route netlink.Route) string {
+	if route.Table == 0 || route.Table == unix.RT_TABLE_MAIN {
+		return route.Dst.String()
+	}
+
+	return fmt.Sprintf("%d:%s", route.Table, route.Dst)
+}
+
+// containsAnyIP 判断子网中是否包含列表中的某个地址
+func containsAnyIP(subnet *net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsIP 判断地址是否在子网列表中的某个子网内
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, s := range subnets {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsSubnet 判断子网列表中是否包含指定的子网
+func containsSubnet(subnets []*net.IPNet, subnet *net.IPNet) bool {
+	for _, s := range subnets {
+		if s != nil && s.String() == subnet.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setupBackends 初始化当前的后端以及上次运行时仍在使用的后端, 并清理其他后端的残留状态
+// 从节点注解中恢复用于发送的后端, 切换完成之前继续使用
+func (r *Reconciler) setupBackends(node *corev1.Node, annotations map[string]string) error {
+	r.hostGW = backend.NewHostGW(r.hostLink)
+	r.backends = make(map[string]backend.Backend)
+	r.peers = make(map[string]map[string]bool)
+
+	keep := map[string]bool{r.config.backend: true}
+	r.active = r.config.backend
+	if active := node.Annotations[backend.BackendAnnotation]; slices.Contains(backendNames, active) {
+		keep[active] = true
+		r.active = active
+	}
+	for _, name := range strings.Split(node.Annotations[backend.BackendReadyAnnotation], ",") {
+		if slices.Contains(backendNames, name) {
+			keep[name] = true
+		}
+	}
+
+	for _, name := range backendNames {
+		b := r.newBackend(name)
+		if !keep[name] {
+			if err := b.Close(); err != nil {
+				return fmt.Errorf("failed to close backend %s: %v", name, err)
+			}
+			continue
+		}
+		if err := b.Init(annotations); err != nil {
+			return fmt.Errorf("failed to init backend %s: %v", name, err)
+		}
+		r.backends[name] = b
+		r.peers[name] = make(map[string]bool)
+		log.Info("init backend success", "backend", name)
+	}
+
+	annotations[backend.BackendAnnotation] = r.active
+	annotations[backend.BackendReadyAnnotation] = r.readyBackends()
+	return nil
+}
+
+// newBackend 创建后端, 当前后端的设备使用 Pod 的 MTU, 旧后端的设备使用各自的封装开销
+func (r *Reconciler) newBackend(name string) backend.Backend {
+	mtu := r.hostLink.Attrs().MTU - backendOverhead(name)
+	if name == r.config.backend {
+		mtu = r.subnetConfig.MTU
+	}
+
+	switch name {
+	case backend.NameVXLAN:
+		return backend.NewVXLAN(r.config.vxlanVNI, r.config.vxlanPort, r.hostLink, r.hostIP, r.nodeCIDR, mtu)
+	case backend.NameIPIP:
+		return backend.NewIPIP(r.hostLink, r.hostIP, r.nodeCIDR, mtu)
+	case backend.NameGeneve:
+		return backend.NewGeneve(r.config.geneveVNI, r.config.genevePort, r.hostIP, r.nodeCIDR, mtu)
+	default:
+		return backend.NewHostGW(r.hostLink)
+	}
+}
+
+// setupPeer 在后端中建立到对端节点的状态, 对端节点还没有发布后端需要的信息时返回空
+func (r *Reconciler) setupPeer(b backend.Backend, peer *backend.Peer, seen map[string]map[string]bool) (*backend.Nexthop, error) {
+	if !b.PeerReady(peer) {
+		log.Info("wait for peer", "backend", b.Name(), "node", peer.Name)
+		return nil, nil
+	}
+
+	nexthop, err := b.SetupPeer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup peer %s of backend %s: %v", peer.Name, b.Name(), err)
+	}
+	r.peers[b.Name()][peer.Name] = true
+	seen[b.Name()][peer.Name] = true
+
+	return nexthop, nil
+}
+
+// teardownPeers 删除本次调谐没有建立的对端节点的状态
+func (r *Reconciler) teardownPeers(seen map[string]map[string]bool) error {
+	for name, b := range r.backends {
+		for peer := range r.peers[name] {
+			if seen[name][peer] {
+				continue
+			}
+			if err := b.TeardownPeer(peer); err != nil {
+				return fmt.Errorf("failed to teardown peer %s of backend %s: %v", peer, name, err)
+			}
+			delete(r.peers[name], peer)
+			log.Info("teardown peer", "backend", name, "node", peer)
+		}
+
+		if p, ok := b.(backend.Pruner); ok {
+			if err := p.Prune(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// switchBackend 在所有对端节点都可以接收当前后端的流量后切换到当前后端, 并返回对端节点用于发送的后端
+func (r *Reconciler) switchBackend(nodes *corev1.NodeList) map[string]bool {
+	ready := true
+	inUse := make(map[string]bool)
+	for _, node := range nodes.Items {
+		if node.Name == r.config.nodeName || len(node.Spec.PodCIDR) == 0 {
+			continue
+		}
+		if !slices.Contains(strings.Split(node.Annotations[backend.BackendReadyAnnotation], ","), r.config.backend) {
+			ready = false
+		}
+		inUse[node.Annotations[backend.BackendAnnotation]] = true
+	}
+
+	if r.active != r.config.backend && ready {
+		log.Info("switch backend", "from", r.active, "to", r.config.backend)
+		r.active = r.config.backend
+	}
+
+	return inUse
+}
+
+// closeBackends 关闭本节点和所有对端节点都不再用于发送的旧后端
+func (r *Reconciler) closeBackends(inUse map[string]bool) error {
+	for name, b := range r.backends {
+		if name == r.config.backend || name == r.active || inUse[name] {
+			continue
+		}
+		if err := b.Close(); err != nil {
+			return fmt.Errorf("failed to close backend %s: %v", name, err)
+		}
+		delete(r.backends, name)
+		delete(r.peers, name)
+		log.Info("close backend", "backend", name)
+	}
+
+	return nil
+}
+
+// publishBackends 在本节点的注解中更新用于发送的后端和可以接收的后端
+func (r *Reconciler) publishBackends(nodes *corev1.NodeList) error {
+	for _, node := range nodes.Items {
+		if node.Name != r.config.nodeName {
+			continue
+		}
+		if node.Annotations[backend.BackendAnnotation] == r.active && node.Annotations[backend.BackendReadyAnnotation] == r.readyBackends() {
+			return nil
+		}
+		return r.annotateNode(node.DeepCopy(), map[string]string{
+			backend.BackendAnnotation:      r.active,
+			backend.BackendReadyAnnotation: r.readyBackends(),
+		})
+	}
+
+	return nil
+}
+
+// readyBackends 返回已经初始化的后端, 按名称排序后以逗号分隔
+func (r *Reconciler) readyBackends() string {
+	var names []string
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// backendOverhead 返回后端的封装开销
+func backendOverhead(name string) int {
+	switch name {
+	case backend.NameVXLAN:
+		return backend.VXLANOverhead
+	case backend.NameIPIP:
+		return backend.IPIPOverhead
+	case backend.NameGeneve:
+		return backend.GeneveOverhead
+	default:
+		return 0
+	}
+}
+
+// defaultOverhead 返回默认的封装开销, 即加密方式和本节点仍在使用的后端中最大的开销
+// 在线切换后端期间新建的 Pod 经由新旧后端发送都不会超过隧道设备的 MTU
+func defaultOverhead(d *DaemonConfig, node *corev1.Node) int {
+	overhead := backendOverhead(d.backend)
+	switch d.encryption {
+	case encryptionWireGuard:
+		overhead = backend.WireGuardOverhead
+	case encryptionIPsec:
+		overhead = backend.IPsecOverhead
+	}
+
+	names := append(strings.Split(node.Annotations[backend.BackendReadyAnnotation], ","), node.Annotations[backend.BackendAnnotation])
+	for _, name := range names {
+		overhead = max(overhead, backendOverhead(name))
+	}
+
+	return overhead
+}
+
+// checkBackendSwitch 拒绝在线切换到承载不了已有 Pod 的 MTU 的后端
+// 已有的 Pod 使用插件配置中的 MTU, 没有配置时使用上次运行时写入子网配置的 MTU
+func checkBackendSwitch(name string, node *corev1.Node, hostMTU, pluginMTU int) error {
+	active := node.Annotations[backend.BackendAnnotation]
+	if active == "" || active == name {
+		return nil
+	}
+
+	podMTU := pluginMTU
+	if podMTU == 0 {
+		prev, err := raccoonConf.LoadSubnetConfig("")
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		podMTU = prev.MTU
+	}
+
+	if limit := hostMTU - backendOverhead(name); podMTU > limit {
+		return fmt.Errorf("pods on node %s use mtu %d but backend %s carries at most %d, "+
+			"keep --backend=%s with --encap-overhead=%d and recreate the pods before switching",
+			node.Name, podMTU, name, limit, active, backendOverhead(name))
+	}
+
+	return nil
+}
+
+// setupWireGuard 加载本节点的私钥并创建 WireGuard 设备, 公钥和地址记录在注解中
+func (r *Reconciler) setupWireGuard(node *corev1.Node, annotations map[string]string) error {
+	key, err := backend.LoadWireGuardKey(backend.DefaultWireGuardKeyFile)
+	if err != nil {
+		return err
+	}
+	// raccoond 停止期间请求的轮换在启动时完成
+	if rotation := node.Annotations[backend.WireGuardRotateAnnotation]; rotation != "" && rotation != key.Rotation {
+		if key, err = backend.GenerateWireGuardKey(rotation); err != nil {
+			return err
+		}
+		if err := backend.StoreWireGuardKey(backend.DefaultWireGuardKeyFile, key); err != nil {
+			return err
+		}
+		log.Info("rotate wireguard key", "rotation", rotation)
+	}
+	r.wgKey = key
+
+	r.wireguard, err = backend.CreateWireGuard(backend.WireGuardName, key, r.config.wireguardPort, r.subnetConfig.MTU)
+	if err != nil {
+		return err
+	}
+	// 宿主机访问其他节点的容器时使用 WireGuard 设备上的地址作为源地址
+	if err := backend.SetTunnelAddr(r.wireguard, r.nodeCIDR); err != nil {
+		return fmt.Errorf("failed to set address of %s: %v", backend.WireGuardName, err)
+	}
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	annotations[backend.WireGuardPublicKeyAnnotation] = base64.StdEncoding.EncodeToString(publicKey)
+	annotations[backend.WireGuardEndpointAnnotation] = net.JoinHostPort(r.hostIP.String(), strconv.Itoa(r.config.wireguardPort))
+
+	return nil
+}
+
+// rotateWireGuardKey 在本节点的轮换注解变化时生成新的私钥, 并更新公钥注解, 对端节点随后更新对端配置
+func (r *Reconciler) rotateWireGuardKey(node *corev1.Node) error {
+	rotation := node.Annotations[backend.WireGuardRotateAnnotation]
+	if rotation == "" || rotation == r.wgKey.Rotation {
+		return nil
+	}
+
+	key, err := backend.GenerateWireGuardKey(rotation)
+	if err != nil {
+		return err
+	}
+	if err := backend.StoreWireGuardKey(backend.DefaultWireGuardKeyFile, key); err != nil {
+		return err
+	}
+	if err := backend.SetWireGuardKey(backend.WireGuardName, key, r.config.wireguardPort, false); err != nil {
+		return err
+	}
+	r.wgKey = key
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	if err := r.annotateNode(node, map[string]string{
+		backend.WireGuardPublicKeyAnnotation: base64.StdEncoding.EncodeToString(publicKey),
+	}); err != nil {
+		return fmt.Errorf("failed to annotate node: %v", err)
+	}
+
+	log.Info("rotate wireguard key", "rotation", rotation)
+	return nil
+}
+
+// wireGuardPeer 根据对端节点的注解生成对端配置, AllowedIPs 是对端节点经由 WireGuard 路由的子网
+// 对端节点还没有写入注解时返回空
+func (r *Reconciler) wireGuardPeer(node *corev1.Node, subnets []*net.IPNet) *backend.WireGuardPeer {
+	publicKey, err := backend.ParseWireGuardKey(node.Annotations[backend.WireGuardPublicKeyAnnotation])
+	if err != nil {
+		log.Info("wait for wireguard public key", "node", node.Name)
+		return nil
+	}
+
+	endpoint, err := net.ResolveUDPAddr("udp4", node.Annotations[backend.WireGuardEndpointAnnotation])
+	if err != nil {
+		log.Info("wait for wireguard endpoint", "node", node.Name)
+		return nil
+	}
+
+	return &backend.WireGuardPeer{PublicKey: publicKey, Endpoint: endpoint, AllowedIPs: r.encryptedSubnets(subnets)}
+}
+
+// encryptedSubnets 返回 nodeSubnets 的结果中需要加密的子网, VLAN 网络经由网桥直接转发, 不经过加密
+func (r *Reconciler) encryptedSubnets(subnets []*net.IPNet) []*net.IPNet {
+	var result []*net.IPNet
+	for i, cidr := range subnets {
+		if cidr == nil || (i > 0 && r.vlanBridges[r.networks[i-1].Name] != nil) {
+			continue
+		}
+		result = append(result, cidr)
+	}
+
+	return result
+}
+
+// syncWireGuardPeers 写入变化的对端配置, 并删除已经不存在的对端节点
+func (r *Reconciler) syncWireGuardPeers(peers map[string]*backend.WireGuardPeer) error {
+	if r.config.encryption != encryptionWireGuard {
+		return nil
+	}
+
+	for name, peer := range peers {
+		cur, ok := r.wgPeers[name]
+		if ok && wireGuardPeerEqual(cur, peer) {
+			continue
+		}
+		// 对端轮换密钥后删除旧公钥对应的对端
+		if ok && !bytes.Equal(cur.PublicKey, peer.PublicKey) {
+			if err := backend.RemoveWireGuardPeer(backend.WireGuardName, cur.PublicKey); err != nil {
+				return err
+			}
+			delete(r.wgPeers, name)
+		}
+		if err := backend.SetWireGuardPeer(backend.WireGuardName, peer); err != nil {
+			return err
+		}
+		r.wgPeers[name] = peer
+		log.Info("set wireguard peer", "node", name, "endpoint", peer.Endpoint.String(), "allowed ips", peer.AllowedIPs)
+	}
+
+	for name, cur := range r.wgPeers {
+		if _, ok := peers[name]; ok {
+			continue
+		}
+		if err := backend.RemoveWireGuardPeer(backend.WireGuardName, cur.PublicKey); err != nil {
+			return err
+		}
+		delete(r.wgPeers, name)
+		log.Info("delete wireguard peer", "node", name)
+	}
+
+	return nil
+}
+
+// setupIPsec 记录本节点的 boot_id, 并加载已经添加的 state 和 policy, raccoond 重启时不会中断加密
+func (r *Reconciler) setupIPsec(annotations map[string]string) error {
+	bootID, err := backend.BootID()
+	if err != nil {
+		return err
+	}
+	r.bootID = bootID
+	annotations[backend.IPsecBootIDAnnotation] = bootID
+
+	states, err := backend.IPsecStates()
+	if err != nil {
+		return err
+	}
+	r.xfrmStates = make(map[string]netlink.XfrmState)
+	for _, s := range states {
+		r.xfrmStates[xfrmStateKey(&s)] = s
+	}
+
+	policies, err := backend.IPsecPolicyList()
+	if err != nil {
 		return err
 	}
+	r.xfrmPolicies = make(map[string]netlink.XfrmPolicy)
+	for _, p := range policies {
+		r.xfrmPolicies[xfrmPolicyKey(&p)] = p
+	}
+
+	return nil
+}
+
+// ipsecPSK 从 Secret 中读取预共享密钥, 每次调谐时重新读取, 修改 Secret 后在下次调谐时生效
+func (r *Reconciler) ipsecPSK(ctx context.Context) ([]byte, error) {
+	namespace, name, _ := strings.Cut(r.config.ipsecSecret, "/")
+	secret := &corev1.Secret{}
+	if err := r.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, fmt.Errorf("failed to get ipsec secret %s: %v", r.config.ipsecSecret, err)
+	}
+
+	psk := secret.Data[ipsecPSKKey]
+	if len(psk) < 32 {
+		return nil, fmt.Errorf("ipsec secret %s must have a %s of at least 32 bytes", r.config.ipsecSecret, ipsecPSKKey)
+	}
+
+	return psk, nil
+}
+
+// syncIPsec 添加缺少的 state 和 policy, 并删除不再需要的 policy 和已经过期的 state
+// 对端节点删除或者密钥变化后, 当前周期的 state 保留到周期结束, 避免以相同的密钥重新从序号 0 开始发送
+func (r *Reconciler) syncIPsec(states map[string]netlink.XfrmState, policies map[string]netlink.XfrmPolicy, epoch int64) error {
+	if r.config.encryption != encryptionIPsec {
+		return nil
+	}
+
+	// 先添加 state 再添加 policy, policy 生效时已经有可用的 state
+	for key, s := range states {
+		if _, ok := r.xfrmStates[key]; ok {
+			continue
+		}
+		if err := backend.AddIPsecState(&s); err != nil {
+			return err
+		}
+		r.xfrmStates[key] = s
+		log.Info("add ipsec state", "src", s.Src.String(), "dst", s.Dst.String(), "spi", fmt.Sprintf("0x%x", s.Spi))
+	}
+
+	for key, p := range policies {
+		if cur, ok := r.xfrmPolicies[key]; ok && cur.Tmpls[0].Src.Equal(p.Tmpls[0].Src) && cur.Tmpls[0].Dst.Equal(p.Tmpls[0].Dst) {
+			continue
+		}
+		if err := netlink.XfrmPolicyUpdate(&p); err != nil {
+			return fmt.Errorf("failed to update xfrm policy %s: %v", key, err)
+		}
+		r.xfrmPolicies[key] = p
+		log.Info("update ipsec policy", "policy", key)
+	}
+
+	for key, p := range r.xfrmPolicies {
+		if _, ok := policies[key]; ok {
+			continue
+		}
+		if err := netlink.XfrmPolicyDel(&p); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("failed to delete xfrm policy %s: %v", key, err)
+		}
+		delete(r.xfrmPolicies, key)
+		log.Info("delete ipsec policy", "policy", key)
+	}
+
+	for key, s := range r.xfrmStates {
+		if _, ok := states[key]; ok {
+			continue
+		}
+		// 发送方向只保留当前周期的 state, 接收方向保留相邻周期的 state
+		e := backend.IPsecEpoch(&s)
+		if s.Src.Equal(r.hostIP) && e == epoch&0xf {
+			continue
+		}
+		if !s.Src.Equal(r.hostIP) && (e == (epoch-1)&0xf || e == epoch&0xf || e == (epoch+1)&0xf) {
+			continue
+		}
+		if err := netlink.XfrmStateDel(&s); err != nil && err != unix.ESRCH && err != unix.ENOENT {
+			return fmt.Errorf("failed to delete xfrm state %s: %v", key, err)
+		}
+		delete(r.xfrmStates, key)
+		log.Info("delete ipsec state", "src", s.Src.String(), "dst", s.Dst.String(), "spi", fmt.Sprintf("0x%x", s.Spi))
+	}
 
 	return nil
 }
 
+// xfrmStateKey 返回 state 在 xfrmStates 中的键, 与内核一样以目的地址和 SPI 区分 state
+func xfrmStateKey(s *netlink.XfrmState) string {
+	return fmt.Sprintf("%s/0x%x", s.Dst, s.Spi)
+}
+
+// xfrmPolicyKey 返回 policy 在 xfrmPolicies 中的键, 与内核一样以方向和选择器区分 policy
+func xfrmPolicyKey(p *netlink.XfrmPolicy) string {
+	return fmt.Sprintf("%s %s->%s", p.Dir, p.Src, p.Dst)
+}
+
+// wireGuardPeerEqual 判断两个对端配置是否相同
+func wireGuardPeerEqual(x, y *backend.WireGuardPeer) bool {
+	if !bytes.Equal(x.PublicKey, y.PublicKey) || x.Endpoint.String() != y.Endpoint.String() || len(x.AllowedIPs) != len(y.AllowedIPs) {
+		return false
+	}
+
+	for i := range x.AllowedIPs {
+		if x.AllowedIPs[i].String() != y.AllowedIPs[i].String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nodeChanged 判断节点的 PodCIDR、地址或 raccoon 的注解是否变化
+func nodeChanged(old, new *corev1.Node) bool {
+	if old.Spec.PodCIDR != new.Spec.PodCIDR {
+		return true
+	}
+
+	if !reflect.DeepEqual(old.Status.Addresses, new.Status.Addresses) {
+		return true
+	}
+
+	for _, annotations := range [][2]map[string]string{{old.Annotations, new.Annotations}, {new.Annotations, old.Annotations}} {
+		for k, v := range annotations[0] {
+			if strings.HasPrefix(k, annotationPrefix) && annotations[1][k] != v {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// podChanged 判断 Pod 的变化是否影响网络策略, 即标签、节点、地址或是否结束
+func podChanged(old, new *corev1.Pod) bool {
+	if old.Spec.NodeName != new.Spec.NodeName || old.Status.Phase != new.Status.Phase {
+		return true
+	}
+
+	return !reflect.DeepEqual(old.Labels, new.Labels) || !reflect.DeepEqual(old.Status.PodIPs, new.Status.PodIPs)
+}
+
 func getNodeInternalIP(node *corev1.Node) (net.IP, error) {
 	if node == nil {
 		return nil, fmt.Errorf("empty node")
@@ -354,8 +2139,12 @@ func getNodeInternalIP(node *corev1.Node) (net.IP, error) {
 }
 
 func isRouteEqual(x, y netlink.Route) bool {
-	if x.Dst.IP.Equal(y.Dst.IP) && x.Gw.Equal(y.Gw) && bytes.Equal(x.Dst.Mask, y.Dst.Mask) && x.LinkIndex == y.LinkIndex {
-		return true
+	if !x.Dst.IP.Equal(y.Dst.IP) || !x.Gw.Equal(y.Gw) || !bytes.Equal(x.Dst.Mask, y.Dst.Mask) || x.LinkIndex != y.LinkIndex {
+		return false
 	}
-	return false
+	// 从内核加载的路由不解析 Geneve 的封装, 第一次调谐时会替换一次
+	if x.Encap == nil || y.Encap == nil {
+		return x.Encap == nil && y.Encap == nil
+	}
+	return x.Encap.Equal(y.Encap)
 }
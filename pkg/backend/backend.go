@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// BackendAnnotation 是节点上记录当前用于发送的后端的注解
+	BackendAnnotation = "raccoon.io/backend"
+	// BackendReadyAnnotation 是节点上记录可以接收流量的后端的注解, 以逗号分隔
+	BackendReadyAnnotation = "raccoon.io/backend-ready"
+)
+
+// 后端的名称, 即 --backend 的取值
+const (
+	NameHostGW = "host-gw" // 经由对端节点 InternalIP 直接路由, 要求所有节点在同一个二层网络
+	NameVXLAN  = "vxlan"   // 经由 VXLAN 隧道封装, 节点可以在不同的三层网络
+	NameIPIP   = "ipip"    // 经由 IPIP 隧道封装, 开销比 VXLAN 小, 不需要对端的 MAC 地址
+	NameGeneve = "geneve"  // 经由 Geneve 隧道封装, 对端地址由路由上的封装指定
+)
+
+// Peer 是对端节点的信息
+type Peer struct {
+	Name        string
+	IP          net.IP     // 对端节点的 InternalIP
+	PodCIDR     *net.IPNet // 对端节点的 PodCIDR
+	Annotations map[string]string
+}
+
+// Nexthop 是到对端节点子网的下一跳
+type Nexthop struct {
+	LinkIndex int
+	Gw        net.IP
+	Onlink    bool
+	Encap     netlink.Encap // 路由上的隧道封装, 不需要时为空
+}
+
+// Backend 是到对端节点的转发方式
+// raccoond 为每个对端节点调用 SetupPeer, 对端节点删除后调用 TeardownPeer, 不再使用后端时调用 Close
+type Backend interface {
+	// Name 返回后端的名称, 即 --backend 的取值
+	Name() string
+	// Init 创建后端的本地设备, 并在 annotations 中写入对端节点需要的本节点信息
+	Init(annotations map[string]string) error
+	// Links 返回承载到对端节点路由的设备, raccoond 启动时从这些设备加载已有的路由
+	Links() ([]netlink.Link, error)
+	// PeerReady 判断对端节点是否已经在注解中发布了后端需要的信息
+	PeerReady(peer *Peer) bool
+	// SetupPeer 创建到对端节点的状态, 并返回到对端节点子网的下一跳
+	SetupPeer(peer *Peer) (*Nexthop, error)
+	// TeardownPeer 删除到对端节点的状态
+	TeardownPeer(name string) error
+	// Close 删除后端的所有本地设备和状态, 未调用 Init 时也可以调用
+	Close() error
+}
+
+// existingLinks 返回已经存在的设备
+func existingLinks(names ...string) ([]netlink.Link, error) {
+	var links []netlink.Link
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+// deleteLink 删除设备, 设备不存在时忽略
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// Pruner 是需要在每次调谐后清理残留状态的后端, 例如 raccoond 停止期间删除的对端节点的设备
+type Pruner interface {
+	// Prune 删除不属于任何已经建立的对端节点的状态
+	Prune() error
+}
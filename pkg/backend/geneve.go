@@ -0,0 +1,289 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// GeneveName 是 raccoond 创建的 Geneve 设备名称
+	GeneveName = "raccoon.geneve"
+	// GeneveOverhead 是不带选项的 Geneve 封装开销, 包括外层 IP、UDP、Geneve 和内层以太网头
+	GeneveOverhead = 50
+	// GeneveMACAnnotation 是节点上记录 Geneve 设备 MAC 地址的注解
+	GeneveMACAnnotation = "raccoon.io/geneve-mac"
+	// GeneveVNIAnnotation 是节点上记录 Geneve VNI 的注解, VNI 不一致的节点之间不建立隧道
+	GeneveVNIAnnotation = "raccoon.io/geneve-vni"
+
+	geneveTTL = 64
+)
+
+// lwtunnel 的 IP 隧道属性, 见 linux/lwtunnel.h
+const (
+	lwtunnelIPID = iota + 1
+	lwtunnelIPDst
+	lwtunnelIPSrc
+	lwtunnelIPTTL
+	lwtunnelIPTOS
+	lwtunnelIPFlags
+)
+
+// tunnelKey 表示隧道元数据中的 ID 有效, 见 TUNNEL_KEY
+const tunnelKey = 0x4
+
+// GeneveEncap 是路由上的 IP 隧道封装, 经由 collect_metadata 模式的 Geneve 设备发往 Dst
+type GeneveEncap struct {
+	VNI int
+	Src net.IP
+	Dst net.IP
+}
+
+func (e *GeneveEncap) Type() int {
+	return nl.LWTUNNEL_ENCAP_IP
+}
+
+func (e *GeneveEncap) Decode(buf []byte) error {
+	attrs, err := nl.ParseRouteAttr(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case lwtunnelIPID:
+			if len(attr.Value) != 8 {
+				return fmt.Errorf("invalid tunnel id %v", attr.Value)
+			}
+			e.VNI = int(binary.BigEndian.Uint64(attr.Value))
+		case lwtunnelIPDst:
+			e.Dst = net.IP(attr.Value)
+		case lwtunnelIPSrc:
+			e.Src = net.IP(attr.Value)
+		}
+	}
+
+	return nil
+}
+
+func (e *GeneveEncap) Encode() ([]byte, error) {
+	src, dst := e.Src.To4(), e.Dst.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("geneve encap requires ipv4 addresses, got %s and %s", e.Src, e.Dst)
+	}
+
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(e.VNI))
+	flags := make([]byte, 2)
+	binary.BigEndian.PutUint16(flags, tunnelKey)
+
+	var buf []byte
+	for _, attr := range []*nl.RtAttr{
+		nl.NewRtAttr(lwtunnelIPID, id),
+		nl.NewRtAttr(lwtunnelIPDst, dst),
+		nl.NewRtAttr(lwtunnelIPSrc, src),
+		nl.NewRtAttr(lwtunnelIPTTL, nl.Uint8Attr(geneveTTL)),
+		nl.NewRtAttr(lwtunnelIPFlags, flags),
+	} {
+		buf = append(buf, attr.Serialize()...)
+	}
+
+	return buf, nil
+}
+
+func (e *GeneveEncap) String() string {
+	return fmt.Sprintf("ip id %d src %s dst %s", e.VNI, e.Src, e.Dst)
+}
+
+func (e *GeneveEncap) Equal(x netlink.Encap) bool {
+	o, ok := x.(*GeneveEncap)
+	if !ok {
+		return false
+	}
+	if e == nil || o == nil {
+		return e == o
+	}
+
+	return e.VNI == o.VNI && e.Src.Equal(o.Src) && e.Dst.Equal(o.Dst)
+}
+
+// CreateGeneve 创建 collect_metadata 模式的 Geneve 设备, 对端地址和 VNI 由路由上的封装指定
+// 已经存在但参数不一致时重新创建
+func CreateGeneve(name string, port int, mtu int) (netlink.Link, error) {
+	geneve := &netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+		},
+		Dport:     uint16(port),
+		FlowBased: true,
+	}
+
+	if l, err := netlink.LinkByName(name); err == nil {
+		cur, ok := l.(*netlink.Geneve)
+		if ok && cur.FlowBased && cur.Dport == uint16(port) {
+			geneve = cur
+		} else if err := netlink.LinkDel(l); err != nil {
+			return nil, fmt.Errorf("failed to delete stale %q: %v", name, err)
+		}
+	}
+
+	if geneve.Attrs().Index == 0 {
+		if err := netlink.LinkAdd(geneve); err != nil {
+			return nil, fmt.Errorf("failed to create geneve %q: %v", name, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// AddGenevePeer 添加对端 Geneve 设备地址的 ARP 表项
+func AddGenevePeer(link netlink.Link, gateway net.IP, mac net.HardwareAddr) error {
+	if err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           gateway,
+		HardwareAddr: mac,
+	}); err != nil {
+		return fmt.Errorf("failed to add neighbor %s: %v", gateway, err)
+	}
+
+	return nil
+}
+
+// DelGenevePeer 删除对端 Geneve 设备地址的 ARP 表项, 表项不存在时忽略
+func DelGenevePeer(link netlink.Link, gateway net.IP, mac net.HardwareAddr) error {
+	if err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		IP:           gateway,
+		HardwareAddr: mac,
+	}); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to delete neighbor %s: %v", gateway, err)
+	}
+
+	return nil
+}
+
+// genevePeer 是对端节点的 Geneve 信息
+type genevePeer struct {
+	gateway net.IP           // 对端 Geneve 设备的地址, 即对端 PodCIDR 的网络地址
+	mac     net.HardwareAddr // 对端 Geneve 设备的 MAC 地址
+}
+
+// Geneve 经由一个 Geneve 设备转发, 到每个对端节点的路由上携带封装的对端地址和 VNI
+type Geneve struct {
+	vni     int
+	port    int
+	hostIP  net.IP
+	podCIDR *net.IPNet
+	mtu     int
+	link    netlink.Link
+	peers   map[string]genevePeer // 已经写入 ARP 表项的对端节点
+}
+
+// NewGeneve 创建 Geneve 后端, 设备在 Init 时创建
+func NewGeneve(vni, port int, hostIP net.IP, podCIDR *net.IPNet, mtu int) *Geneve {
+	return &Geneve{vni: vni, port: port, hostIP: hostIP, podCIDR: podCIDR, mtu: mtu, peers: make(map[string]genevePeer)}
+}
+
+func (g *Geneve) Name() string {
+	return NameGeneve
+}
+
+// Init 创建 Geneve 设备, 并发布设备的 MAC 地址和 VNI
+func (g *Geneve) Init(annotations map[string]string) error {
+	link, err := CreateGeneve(GeneveName, g.port, g.mtu)
+	if err != nil {
+		return err
+	}
+	if err := SetTunnelAddr(link, g.podCIDR); err != nil {
+		return fmt.Errorf("failed to set address of %s: %v", GeneveName, err)
+	}
+	g.link = link
+
+	annotations[GeneveMACAnnotation] = link.Attrs().HardwareAddr.String()
+	annotations[GeneveVNIAnnotation] = strconv.Itoa(g.vni)
+	return nil
+}
+
+func (g *Geneve) Links() ([]netlink.Link, error) {
+	return existingLinks(GeneveName)
+}
+
+// PeerReady 判断对端节点是否发布了 MAC 地址并且 VNI 一致, VNI 不一致的节点之间不建立隧道
+func (g *Geneve) PeerReady(peer *Peer) bool {
+	if _, err := net.ParseMAC(peer.Annotations[GeneveMACAnnotation]); err != nil {
+		return false
+	}
+
+	return peer.Annotations[GeneveVNIAnnotation] == strconv.Itoa(g.vni)
+}
+
+// SetupPeer 写入对端 Geneve 设备地址的 ARP 表项, 到对端子网的路由封装后发往对端节点的 InternalIP
+func (g *Geneve) SetupPeer(peer *Peer) (*Nexthop, error) {
+	mac, err := net.ParseMAC(peer.Annotations[GeneveMACAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	p := genevePeer{gateway: peer.PodCIDR.IP, mac: mac}
+	if cur, ok := g.peers[peer.Name]; !ok || !cur.gateway.Equal(p.gateway) || cur.mac.String() != p.mac.String() {
+		// 对端信息变化时先删除旧的表项
+		if err := g.TeardownPeer(peer.Name); err != nil {
+			return nil, err
+		}
+		if err := AddGenevePeer(g.link, p.gateway, p.mac); err != nil {
+			return nil, err
+		}
+		g.peers[peer.Name] = p
+	}
+
+	return &Nexthop{
+		LinkIndex: g.link.Attrs().Index,
+		Gw:        p.gateway,
+		Onlink:    true,
+		Encap:     &GeneveEncap{VNI: g.vni, Src: g.hostIP, Dst: peer.IP},
+	}, nil
+}
+
+func (g *Geneve) TeardownPeer(name string) error {
+	cur, ok := g.peers[name]
+	if !ok {
+		return nil
+	}
+	if err := DelGenevePeer(g.link, cur.gateway, cur.mac); err != nil {
+		return err
+	}
+	delete(g.peers, name)
+
+	return nil
+}
+
+// Close 删除 Geneve 设备, 表项和设备上的路由会一起删除
+func (g *Geneve) Close() error {
+	g.peers = make(map[string]genevePeer)
+	return deleteLink(GeneveName)
+}
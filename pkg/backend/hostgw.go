@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// HostGW 经由对端节点的 InternalIP 直接路由, 要求所有节点在同一个二层网络
+type HostGW struct {
+	hostLink netlink.Link
+}
+
+// NewHostGW 创建经由宿主机网卡的 host-gw 后端
+func NewHostGW(hostLink netlink.Link) *HostGW {
+	return &HostGW{hostLink: hostLink}
+}
+
+func (h *HostGW) Name() string {
+	return NameHostGW
+}
+
+func (h *HostGW) Init(annotations map[string]string) error {
+	return nil
+}
+
+func (h *HostGW) Links() ([]netlink.Link, error) {
+	return []netlink.Link{h.hostLink}, nil
+}
+
+func (h *HostGW) PeerReady(peer *Peer) bool {
+	return true
+}
+
+func (h *HostGW) SetupPeer(peer *Peer) (*Nexthop, error) {
+	return &Nexthop{LinkIndex: h.hostLink.Attrs().Index, Gw: peer.IP}, nil
+}
+
+func (h *HostGW) TeardownPeer(name string) error {
+	return nil
+}
+
+// Close 不需要删除任何状态, 路由由 raccoond 删除
+func (h *HostGW) Close() error {
+	return nil
+}
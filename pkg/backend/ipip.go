@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// IPIPName 是 raccoond 创建的 IPIP 设备名称
+	IPIPName = "raccoon.ipip"
+	// IPIPOverhead 是 IPIP 封装的开销, 即外层 IP 头
+	IPIPOverhead = 20
+)
+
+// CreateIPIP 创建本端地址为 hostIP、不指定对端地址的 IPIP 设备, 已经存在但参数不一致时重新创建
+// 到对端节点的路由以对端 InternalIP 作为 onlink 网关, 内核将其作为外层目的地址
+func CreateIPIP(name string, hostLink netlink.Link, hostIP net.IP, mtu int) (netlink.Link, error) {
+	if l, err := netlink.LinkByName(name); err == nil {
+		cur, ok := l.(*netlink.Iptun)
+		if !ok || !cur.Local.Equal(hostIP) || cur.Link != uint32(hostLink.Attrs().Index) {
+			if err := netlink.LinkDel(l); err != nil {
+				return nil, fmt.Errorf("failed to delete stale %q: %v", name, err)
+			}
+		}
+	}
+
+	if _, err := netlink.LinkByName(name); err != nil {
+		iptun := &netlink.Iptun{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+				MTU:  mtu,
+			},
+			Link:     uint32(hostLink.Attrs().Index),
+			Local:    hostIP,
+			PMtuDisc: 1,
+		}
+		if err := netlink.LinkAdd(iptun); err != nil {
+			return nil, fmt.Errorf("failed to create ipip %q: %v", name, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// IPIP 经由 IPIP 设备转发, 不需要对端节点的信息
+type IPIP struct {
+	hostLink netlink.Link
+	hostIP   net.IP
+	podCIDR  *net.IPNet
+	mtu      int
+	link     netlink.Link
+}
+
+// NewIPIP 创建 IPIP 后端, 设备在 Init 时创建
+func NewIPIP(hostLink netlink.Link, hostIP net.IP, podCIDR *net.IPNet, mtu int) *IPIP {
+	return &IPIP{hostLink: hostLink, hostIP: hostIP, podCIDR: podCIDR, mtu: mtu}
+}
+
+func (i *IPIP) Name() string {
+	return NameIPIP
+}
+
+// Init 创建 IPIP 设备, 宿主机访问其他节点的容器时使用设备上的地址作为源地址
+func (i *IPIP) Init(annotations map[string]string) error {
+	link, err := CreateIPIP(IPIPName, i.hostLink, i.hostIP, i.mtu)
+	if err != nil {
+		return err
+	}
+	if err := SetTunnelAddr(link, i.podCIDR); err != nil {
+		return fmt.Errorf("failed to set address of %s: %v", IPIPName, err)
+	}
+	i.link = link
+
+	return nil
+}
+
+func (i *IPIP) Links() ([]netlink.Link, error) {
+	return existingLinks(IPIPName)
+}
+
+func (i *IPIP) PeerReady(peer *Peer) bool {
+	return true
+}
+
+// SetupPeer 返回以对端 InternalIP 为 onlink 网关的下一跳
+func (i *IPIP) SetupPeer(peer *Peer) (*Nexthop, error) {
+	return &Nexthop{LinkIndex: i.link.Attrs().Index, Gw: peer.IP, Onlink: true}, nil
+}
+
+func (i *IPIP) TeardownPeer(name string) error {
+	return nil
+}
+
+// Close 删除 IPIP 设备, 设备上的路由会一起删除
+func (i *IPIP) Close() error {
+	return deleteLink(IPIPName)
+}
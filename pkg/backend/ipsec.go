@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// IPsecOverhead 是 ESP 隧道模式使用 AES-GCM 时的封装开销, 包括外层 IP、ESP 头、IV、填充和 ICV
+	IPsecOverhead = 60
+	// IPsecBootIDAnnotation 是节点上记录内核 boot_id 的注解, 参与密钥派生, 节点重启后使用新的密钥
+	IPsecBootIDAnnotation = "raccoon.io/ipsec-boot-id"
+	// IPsecReqID 是 raccoond 添加的 XFRM state 和 policy 模板的 reqid, 用于区分其他程序添加的配置
+	IPsecReqID = 0x72636e
+
+	ipsecAead    = "rfc4106(gcm(aes))"
+	ipsecICVLen  = 128
+	ipsecKeyLen  = 36 // 32 字节的 AES-256 密钥和 4 字节的 salt
+	ipsecBootID  = "/proc/sys/kernel/random/boot_id"
+	ipsecSPIMask = 0x0fffffff
+
+	// ipsecReplayWindow 是接收方向的防重放窗口, state 使用 64 位的扩展序号 (ESN) 避免序号回绕
+	// 不设置包数上限, 硬上限到期后重新添加的 state 会以相同的密钥从序号 0 开始
+	ipsecReplayWindow = 32
+)
+
+// BootID 返回宿主机内核的 boot_id
+func BootID() (string, error) {
+	data, err := os.ReadFile(ipsecBootID)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// IPsecState 根据预共享密钥派生从 src 到 dst 的 ESP 隧道 state, 两端节点派生出相同的 SPI 和密钥
+// epoch 是密钥轮换的周期, bootID 是发送端节点的 boot_id, 保证发送端重启后不会以相同的密钥重新从序号 0 开始
+// SPI 的高 4 位是 epoch 的低 4 位, 用于识别 state 所属的周期
+func IPsecState(psk []byte, src, dst net.IP, epoch int64, bootID string) *netlink.XfrmState {
+	mac := hmac.New(sha512.New, psk)
+	fmt.Fprintf(mac, "raccoon ipsec %s %s %d %s", src, dst, epoch, bootID)
+	sum := mac.Sum(nil)
+
+	spi := int(binary.BigEndian.Uint32(sum[ipsecKeyLen:])&ipsecSPIMask|0x100) | int(epoch&0xf)<<28
+
+	return &netlink.XfrmState{
+		Src:   src,
+		Dst:   dst,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Mode:  netlink.XFRM_MODE_TUNNEL,
+		Spi:   spi,
+		Reqid: IPsecReqID,
+		Aead: &netlink.XfrmStateAlgo{
+			Name:   ipsecAead,
+			Key:    sum[:ipsecKeyLen],
+			ICVLen: ipsecICVLen,
+		},
+		ReplayWindow: ipsecReplayWindow,
+		ESN:          true,
+	}
+}
+
+// IPsecEpoch 返回 state 所属周期的低 4 位
+func IPsecEpoch(state *netlink.XfrmState) int64 {
+	return int64(uint32(state.Spi) >> 28)
+}
+
+// AddIPsecState 添加 state, 已经存在时忽略, SPI 由密钥派生, 相同的 SPI 对应相同的密钥
+func AddIPsecState(state *netlink.XfrmState) error {
+	if err := netlink.XfrmStateAdd(state); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add xfrm state %s->%s spi 0x%x: %v", state.Src, state.Dst, state.Spi, err)
+	}
+
+	return nil
+}
+
+// IPsecPolicies 返回 local 与 remote 之间的 ESP 隧道 policy
+// 从 localSubnets 到 remoteSubnets 的报文加密后发往 remote, 从 remoteSubnets 到 localSubnets 的报文必须经过解密
+func IPsecPolicies(local, remote net.IP, localSubnets, remoteSubnets []*net.IPNet) []netlink.XfrmPolicy {
+	tmpl := func(src, dst net.IP) []netlink.XfrmPolicyTmpl {
+		return []netlink.XfrmPolicyTmpl{{
+			Src:   src,
+			Dst:   dst,
+			Proto: netlink.XFRM_PROTO_ESP,
+			Mode:  netlink.XFRM_MODE_TUNNEL,
+			Reqid: IPsecReqID,
+		}}
+	}
+
+	var policies []netlink.XfrmPolicy
+	for _, l := range localSubnets {
+		for _, r := range remoteSubnets {
+			policies = append(policies,
+				netlink.XfrmPolicy{Src: l, Dst: r, Dir: netlink.XFRM_DIR_OUT, Tmpls: tmpl(local, remote)},
+				netlink.XfrmPolicy{Src: r, Dst: l, Dir: netlink.XFRM_DIR_IN, Tmpls: tmpl(remote, local)},
+				netlink.XfrmPolicy{Src: r, Dst: l, Dir: netlink.XFRM_DIR_FWD, Tmpls: tmpl(remote, local)},
+			)
+		}
+	}
+
+	return policies
+}
+
+// IPsecStates 返回 raccoond 添加的所有 state
+func IPsecStates() ([]netlink.XfrmState, error) {
+	states, err := netlink.XfrmStateList(netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []netlink.XfrmState
+	for _, s := range states {
+		if s.Reqid == IPsecReqID {
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+// IPsecPolicyList 返回 raccoond 添加的所有 policy
+func IPsecPolicyList() ([]netlink.XfrmPolicy, error) {
+	policies, err := netlink.XfrmPolicyList(netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []netlink.XfrmPolicy
+	for _, p := range policies {
+		if len(p.Tmpls) == 1 && p.Tmpls[0].Reqid == IPsecReqID {
+			result = append(result, p)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestIPsecState(t *testing.T) {
+	psk := bytes.Repeat([]byte{0x5a}, 32)
+	a, b := net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")
+	bootA, bootB := "1b1c0c2e-0e52-4f3a-9d8e-000000000001", "1b1c0c2e-0e52-4f3a-9d8e-000000000002"
+
+	// a 派生发送的 state, b 根据 a 发布的 boot_id 派生接收的 state, SPI 和密钥必须一致
+	out := IPsecState(psk, a, b, 100, bootA)
+	in := IPsecState(psk, a, b, 100, bootA)
+	if out.Spi != in.Spi || !bytes.Equal(out.Aead.Key, in.Aead.Key) {
+		t.Fatalf("got spi 0x%x and 0x%x for the same direction", out.Spi, in.Spi)
+	}
+	if !out.Src.Equal(a) || !out.Dst.Equal(b) || len(out.Aead.Key) != ipsecKeyLen {
+		t.Fatalf("unexpected state %+v", out)
+	}
+
+	// SPI 的高 4 位是周期的低 4 位, 不会与内核保留的 SPI 冲突
+	if IPsecEpoch(out) != 100&0xf || out.Spi&0x0fffffff < 0x100 {
+		t.Fatalf("unexpected spi 0x%x for epoch 100", out.Spi)
+	}
+
+	// 相邻周期、反方向以及发送端重启后使用不同的 SPI 和密钥
+	for _, tc := range []struct {
+		name     string
+		psk      []byte
+		src, dst net.IP
+		epoch    int64
+		bootID   string
+	}{
+		{"next epoch", psk, a, b, 101, bootA},
+		{"reverse", psk, b, a, 100, bootB},
+		{"reboot", psk, a, b, 100, bootB},
+		{"psk", bytes.Repeat([]byte{0xa5}, 32), a, b, 100, bootA},
+	} {
+		s := IPsecState(tc.psk, tc.src, tc.dst, tc.epoch, tc.bootID)
+		if s.Spi == out.Spi || bytes.Equal(s.Aead.Key, out.Aead.Key) {
+			t.Fatalf("%s: got the same spi 0x%x or key", tc.name, s.Spi)
+		}
+	}
+	if next := IPsecState(psk, a, b, 101, bootA); IPsecEpoch(next) != IPsecEpoch(out)+1 {
+		t.Fatalf("got epoch %d after %d", IPsecEpoch(next), IPsecEpoch(out))
+	}
+}
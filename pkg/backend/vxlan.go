@@ -0,0 +1,242 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// VXLANName 是 raccoond 创建的 VXLAN 设备名称
+	VXLANName = "raccoon.vxlan"
+	// VXLANOverhead 是 VXLAN 封装的开销, 包括外层 IP、UDP、VXLAN 和内层以太网头
+	VXLANOverhead = 50
+	// VTEPMACAnnotation 是节点上记录 VXLAN 设备 MAC 地址的注解
+	VTEPMACAnnotation = "raccoon.io/vtep-mac"
+)
+
+// CreateVXLAN 创建经由宿主机网卡封装的 VXLAN 设备, 已经存在但参数不一致时重新创建
+// 关闭地址学习, 对端的 MAC 地址和 VTEP 地址由 raccoond 根据节点信息写入
+func CreateVXLAN(name string, vni, port int, hostLink netlink.Link, hostIP net.IP, mtu int) (netlink.Link, error) {
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+		},
+		VxlanId:      vni,
+		VtepDevIndex: hostLink.Attrs().Index,
+		SrcAddr:      hostIP,
+		Port:         port,
+		Learning:     false,
+	}
+
+	if l, err := netlink.LinkByName(name); err == nil {
+		cur, ok := l.(*netlink.Vxlan)
+		if ok && cur.VxlanId == vni && cur.Port == port && cur.VtepDevIndex == hostLink.Attrs().Index && cur.SrcAddr.Equal(hostIP) {
+			vxlan = cur
+		} else if err := netlink.LinkDel(l); err != nil {
+			return nil, fmt.Errorf("failed to delete stale %q: %v", name, err)
+		}
+	}
+
+	if vxlan.Attrs().Index == 0 {
+		if err := netlink.LinkAdd(vxlan); err != nil {
+			return nil, fmt.Errorf("failed to create vxlan %q: %v", name, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// SetTunnelAddr 将节点子网的网络地址以 /32 配置在隧道设备上, 作为其他节点路由的网关
+func SetTunnelAddr(link netlink.Link, podCIDR *net.IPNet) error {
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: podCIDR.IP, Mask: net.CIDRMask(32, 32)}}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			continue
+		}
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+	}
+
+	if err := netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+		return err
+	}
+
+	return nil
+}
+
+// AddVXLANPeer 添加对端的 ARP 表项和 FDB 表项, gateway 解析为对端 VXLAN 设备的 MAC 地址, 该 MAC 地址封装后发往 peerIP
+func AddVXLANPeer(link netlink.Link, gateway net.IP, mac net.HardwareAddr, peerIP net.IP) error {
+	if err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           gateway,
+		HardwareAddr: mac,
+	}); err != nil {
+		return fmt.Errorf("failed to add neighbor %s: %v", gateway, err)
+	}
+
+	if err := netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           peerIP,
+		HardwareAddr: mac,
+	}); err != nil {
+		return fmt.Errorf("failed to add fdb entry %s: %v", mac, err)
+	}
+
+	return nil
+}
+
+// DelVXLANPeer 删除对端的 ARP 表项和 FDB 表项, 表项不存在时忽略
+func DelVXLANPeer(link netlink.Link, gateway net.IP, mac net.HardwareAddr, peerIP net.IP) error {
+	if err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		IP:           gateway,
+		HardwareAddr: mac,
+	}); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to delete neighbor %s: %v", gateway, err)
+	}
+
+	if err := netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           peerIP,
+		HardwareAddr: mac,
+	}); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to delete fdb entry %s: %v", mac, err)
+	}
+
+	return nil
+}
+
+// vxlanPeer 是对端节点的 VXLAN 信息
+type vxlanPeer struct {
+	gateway net.IP           // 对端 VXLAN 设备的地址, 即对端 PodCIDR 的网络地址
+	mac     net.HardwareAddr // 对端 VXLAN 设备的 MAC 地址
+	ip      net.IP           // 对端节点的 InternalIP
+}
+
+// VXLAN 经由 VXLAN 设备转发, 对端的 ARP 和 FDB 表项根据节点注解写入
+type VXLAN struct {
+	vni      int
+	port     int
+	hostLink netlink.Link
+	hostIP   net.IP
+	podCIDR  *net.IPNet
+	mtu      int
+	link     netlink.Link
+	peers    map[string]vxlanPeer // 已经写入 ARP 和 FDB 表项的对端节点
+}
+
+// NewVXLAN 创建 VXLAN 后端, 设备在 Init 时创建
+func NewVXLAN(vni, port int, hostLink netlink.Link, hostIP net.IP, podCIDR *net.IPNet, mtu int) *VXLAN {
+	return &VXLAN{
+		vni:      vni,
+		port:     port,
+		hostLink: hostLink,
+		hostIP:   hostIP,
+		podCIDR:  podCIDR,
+		mtu:      mtu,
+		peers:    make(map[string]vxlanPeer),
+	}
+}
+
+func (v *VXLAN) Name() string {
+	return NameVXLAN
+}
+
+// Init 创建 VXLAN 设备, 并发布设备的 MAC 地址
+func (v *VXLAN) Init(annotations map[string]string) error {
+	link, err := CreateVXLAN(VXLANName, v.vni, v.port, v.hostLink, v.hostIP, v.mtu)
+	if err != nil {
+		return err
+	}
+	if err := SetTunnelAddr(link, v.podCIDR); err != nil {
+		return fmt.Errorf("failed to set address of %s: %v", VXLANName, err)
+	}
+	v.link = link
+
+	annotations[VTEPMACAnnotation] = link.Attrs().HardwareAddr.String()
+	return nil
+}
+
+func (v *VXLAN) Links() ([]netlink.Link, error) {
+	return existingLinks(VXLANName)
+}
+
+func (v *VXLAN) PeerReady(peer *Peer) bool {
+	_, err := net.ParseMAC(peer.Annotations[VTEPMACAnnotation])
+	return err == nil
+}
+
+// SetupPeer 写入对端的 ARP 和 FDB 表项, 到对端子网的下一跳是对端 VXLAN 设备的地址
+func (v *VXLAN) SetupPeer(peer *Peer) (*Nexthop, error) {
+	mac, err := net.ParseMAC(peer.Annotations[VTEPMACAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	p := vxlanPeer{gateway: peer.PodCIDR.IP, mac: mac, ip: peer.IP}
+	if cur, ok := v.peers[peer.Name]; !ok || !cur.gateway.Equal(p.gateway) || !cur.ip.Equal(p.ip) || cur.mac.String() != p.mac.String() {
+		// 对端信息变化时先删除旧的表项
+		if err := v.TeardownPeer(peer.Name); err != nil {
+			return nil, err
+		}
+		if err := AddVXLANPeer(v.link, p.gateway, p.mac, p.ip); err != nil {
+			return nil, err
+		}
+		v.peers[peer.Name] = p
+	}
+
+	return &Nexthop{LinkIndex: v.link.Attrs().Index, Gw: p.gateway, Onlink: true}, nil
+}
+
+func (v *VXLAN) TeardownPeer(name string) error {
+	cur, ok := v.peers[name]
+	if !ok {
+		return nil
+	}
+	if err := DelVXLANPeer(v.link, cur.gateway, cur.mac, cur.ip); err != nil {
+		return err
+	}
+	delete(v.peers, name)
+
+	return nil
+}
+
+// Close 删除 VXLAN 设备, 表项和设备上的路由会一起删除
+func (v *VXLAN) Close() error {
+	v.peers = make(map[string]vxlanPeer)
+	return deleteLink(VXLANName)
+}
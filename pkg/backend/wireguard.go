@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// WireGuardName 是 raccoond 创建的 WireGuard 设备名称
+	WireGuardName = "raccoon.wg"
+	// WireGuardOverhead 是 WireGuard 在 IPv4 上的封装开销
+	WireGuardOverhead = 60
+	// WireGuardPublicKeyAnnotation 是节点上记录 WireGuard 公钥的注解
+	WireGuardPublicKeyAnnotation = "raccoon.io/wireguard-public-key"
+	// WireGuardEndpointAnnotation 是节点上记录 WireGuard 地址和端口的注解
+	WireGuardEndpointAnnotation = "raccoon.io/wireguard-endpoint"
+	// WireGuardRotateAnnotation 是请求轮换密钥的注解, 值变化时重新生成密钥
+	WireGuardRotateAnnotation = "raccoon.io/wireguard-rotate"
+	// DefaultWireGuardKeyFile 是节点上保存 WireGuard 私钥的文件
+	DefaultWireGuardKeyFile = "/var/lib/raccoon/wireguard.json"
+)
+
+// WireGuard 内核接口的 genetlink 常量, 见 include/uapi/linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+	wgCmdSetDev   = 1
+
+	wgDeviceAIfName     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+	wgDeviceFReplace    = 1
+
+	wgPeerAPublicKey  = 1
+	wgPeerAFlags      = 3
+	wgPeerAEndpoint   = 4
+	wgPeerAAllowedIPs = 9
+	wgPeerFRemoveMe   = 1
+	wgPeerFReplaceIPs = 2
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+// WireGuardKey 是节点的 WireGuard 私钥, Rotation 记录最近一次处理的轮换请求
+type WireGuardKey struct {
+	PrivateKey []byte `json:"privateKey"`
+	Rotation   string `json:"rotation,omitempty"`
+}
+
+// WireGuardPeer 是对端节点的 WireGuard 配置
+type WireGuardPeer struct {
+	PublicKey  []byte
+	Endpoint   *net.UDPAddr
+	AllowedIPs []*net.IPNet
+}
+
+// PublicKey 返回私钥对应的公钥
+func (k *WireGuardKey) PublicKey() ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.PublicKey().Bytes(), nil
+}
+
+// GenerateWireGuardKey 生成新的 X25519 私钥
+func GenerateWireGuardKey(rotation string) (*WireGuardKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WireGuardKey{PrivateKey: priv.Bytes(), Rotation: rotation}, nil
+}
+
+// LoadWireGuardKey 加载节点上保存的私钥, 文件不存在时生成新的私钥并保存
+func LoadWireGuardKey(file string) (*WireGuardKey, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		key, err := GenerateWireGuardKey("")
+		if err != nil {
+			return nil, err
+		}
+		return key, StoreWireGuardKey(file, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &WireGuardKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("failed to parse wireguard key: %v", err)
+	}
+	if len(key.PrivateKey) != 32 {
+		return nil, fmt.Errorf("invalid wireguard private key length %d", len(key.PrivateKey))
+	}
+
+	return key, nil
+}
+
+// StoreWireGuardKey 保存私钥, 只有 root 可以读取
+func StoreWireGuardKey(file string, key *WireGuardKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// ParseWireGuardKey 解析 base64 编码的公钥
+func ParseWireGuardKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid wireguard key length %d", len(key))
+	}
+
+	return key, nil
+}
+
+// CreateWireGuard 创建 WireGuard 设备, 并设置私钥和监听端口, 同时清空所有对端
+func CreateWireGuard(name string, key *WireGuardKey, port, mtu int) (netlink.Link, error) {
+	if _, err := netlink.LinkByName(name); err != nil {
+		wg := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}}
+		if err := netlink.LinkAdd(wg); err != nil {
+			return nil, fmt.Errorf("failed to create wireguard %q: %v", name, err)
+		}
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := SetWireGuardKey(name, key, port, true); err != nil {
+		return nil, err
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// SetWireGuardKey 设置设备的私钥和监听端口, replacePeers 为 true 时删除所有对端
+func SetWireGuardKey(name string, key *WireGuardKey, port int, replacePeers bool) error {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(wgDeviceAPrivateKey, key.PrivateKey),
+		nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(port))),
+	}
+	if replacePeers {
+		attrs = append(attrs, nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplace)))
+	}
+
+	return setWireGuardDevice(name, attrs...)
+}
+
+// SetWireGuardPeer 添加或更新对端, 对端的 AllowedIPs 会被替换
+func SetWireGuardPeer(name string, peer *WireGuardPeer) error {
+	p := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	p.AddRtAttr(wgPeerAPublicKey, peer.PublicKey)
+	p.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceIPs))
+	if peer.Endpoint != nil {
+		p.AddRtAttr(wgPeerAEndpoint, sockaddrIn(peer.Endpoint))
+	}
+
+	ips := nl.NewRtAttr(wgPeerAAllowedIPs|unix.NLA_F_NESTED, nil)
+	for i, ipNet := range peer.AllowedIPs {
+		ones, _ := ipNet.Mask.Size()
+		ip := ips.AddRtAttr(i|unix.NLA_F_NESTED, nil)
+		ip.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(unix.AF_INET))
+		ip.AddRtAttr(wgAllowedIPAIPAddr, ipNet.IP.To4())
+		ip.AddRtAttr(wgAllowedIPACidrMask, nl.Uint8Attr(uint8(ones)))
+	}
+	p.AddChild(ips)
+
+	peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+	peers.AddChild(p)
+
+	return setWireGuardDevice(name, peers)
+}
+
+// RemoveWireGuardPeer 删除对端
+func RemoveWireGuardPeer(name string, publicKey []byte) error {
+	p := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	p.AddRtAttr(wgPeerAPublicKey, publicKey)
+	p.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFRemoveMe))
+
+	peers := nl.NewRtAttr(wgDeviceAPeers|unix.NLA_F_NESTED, nil)
+	peers.AddChild(p)
+
+	return setWireGuardDevice(name, peers)
+}
+
+// setWireGuardDevice 通过 genetlink 发送 WG_CMD_SET_DEVICE
+func setWireGuardDevice(name string, attrs ...*nl.RtAttr) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("failed to get genetlink family %s: %v", wgGenlName, err)
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDev, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfName, nl.ZeroTerminated(name)))
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+
+	if _, err := req.Execute(unix.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to configure wireguard %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// sockaddrIn 将地址编码为 struct sockaddr_in
+func sockaddrIn(addr *net.UDPAddr) []byte {
+	b := make([]byte, unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[4:8], addr.IP.To4())
+
+	return b
+}
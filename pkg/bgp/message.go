@@ -0,0 +1,287 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// BGP-4 报文类型, 见 RFC 4271
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	headerLen = 19
+	maxMsgLen = 4096
+
+	// AS_TRANS 是本地 AS 超过 2 字节时在 OPEN 中填写的 AS, 见 RFC 6793
+	asTrans = 23456
+
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	attrFlagTransitive = 0x40
+	attrOrigin         = 1
+	attrASPath         = 2
+	attrNextHop        = 3
+	attrLocalPref      = 5
+	originIGP          = 0
+	asSequence         = 2
+	defaultLocalPref   = 100
+
+	// NOTIFICATION 的错误码和 OPEN、Cease 错误的子码
+	errOpenMessage       = 2
+	errHoldTimer         = 4
+	errCease             = 6
+	errSubBadPeerAS      = 2
+	errSubHoldTime       = 6
+	errSubUnsupportedCap = 7
+	errSubAdminDown      = 2
+)
+
+// message 是收到的 BGP 报文
+type message struct {
+	typ  byte
+	body []byte
+}
+
+// openMessage 是 OPEN 报文中的信息
+type openMessage struct {
+	as            uint32
+	holdTime      uint16
+	routerID      net.IP
+	fourOctetAS   bool
+	ipv4Unicast   bool
+	multiprotocol bool
+}
+
+// notificationError 是对端发送的 NOTIFICATION
+type notificationError struct {
+	code, subcode byte
+}
+
+func (e *notificationError) Error() string {
+	return fmt.Sprintf("notification code %d subcode %d", e.code, e.subcode)
+}
+
+// readMessage 读取一个 BGP 报文
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return nil, fmt.Errorf("invalid bgp marker")
+		}
+	}
+
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMsgLen {
+		return nil, fmt.Errorf("invalid bgp message length %d", length)
+	}
+
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &message{typ: header[18], body: body}, nil
+}
+
+// marshalMessage 生成带有报文头的 BGP 报文
+func marshalMessage(typ byte, body []byte) []byte {
+	b := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		b[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(b[16:18], uint16(headerLen+len(body)))
+	b[18] = typ
+
+	return append(b, body...)
+}
+
+// marshalOpen 生成 OPEN 报文, 声明 IPv4 单播和 4 字节 AS 能力
+func marshalOpen(as uint32, holdTime uint16, routerID net.IP) []byte {
+	myAS := uint16(as)
+	if as > 0xffff {
+		myAS = asTrans
+	}
+
+	caps := []byte{
+		capMultiprotocol, 4, 0, 1, 0, 1,
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], as)
+
+	body := make([]byte, 10, 12+len(caps))
+	body[0] = 4
+	binary.BigEndian.PutUint16(body[1:3], myAS)
+	binary.BigEndian.PutUint16(body[3:5], holdTime)
+	copy(body[5:9], routerID.To4())
+	body[9] = byte(2 + len(caps))
+	// 可选参数类型 2 为能力
+	body = append(body, 2, byte(len(caps)))
+	body = append(body, caps...)
+
+	return marshalMessage(msgOpen, body)
+}
+
+// parseOpen 解析 OPEN 报文
+func parseOpen(body []byte) (*openMessage, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("short open message")
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("unsupported bgp version %d", body[0])
+	}
+
+	open := &openMessage{
+		as:       uint32(binary.BigEndian.Uint16(body[1:3])),
+		holdTime: binary.BigEndian.Uint16(body[3:5]),
+		routerID: net.IP(append([]byte(nil), body[5:9]...)),
+	}
+
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("invalid optional parameters length")
+	}
+	for len(params) >= 2 {
+		typ, l := params[0], int(params[1])
+		if len(params) < 2+l {
+			return nil, fmt.Errorf("invalid optional parameter length")
+		}
+		if typ == 2 {
+			caps := params[2 : 2+l]
+			for len(caps) >= 2 {
+				code, cl := caps[0], int(caps[1])
+				if len(caps) < 2+cl {
+					return nil, fmt.Errorf("invalid capability length")
+				}
+				value := caps[2 : 2+cl]
+				switch {
+				case code == capFourOctetAS && cl == 4:
+					open.fourOctetAS = true
+					open.as = binary.BigEndian.Uint32(value)
+				case code == capMultiprotocol && cl == 4:
+					open.multiprotocol = true
+					if binary.BigEndian.Uint16(value[0:2]) == 1 && value[3] == 1 {
+						open.ipv4Unicast = true
+					}
+				}
+				caps = caps[2+cl:]
+			}
+		}
+		params = params[2+l:]
+	}
+
+	// 没有声明多协议能力的对端只支持 IPv4 单播, 见 RFC 4760
+	if !open.multiprotocol {
+		open.ipv4Unicast = true
+	}
+
+	return open, nil
+}
+
+// marshalNotification 生成 NOTIFICATION 报文
+func marshalNotification(code, subcode byte) []byte {
+	return marshalMessage(msgNotification, []byte{code, subcode})
+}
+
+// parseNotification 解析 NOTIFICATION 报文
+func parseNotification(body []byte) error {
+	if len(body) < 2 {
+		return &notificationError{}
+	}
+
+	return &notificationError{code: body[0], subcode: body[1]}
+}
+
+// updateOptions 是生成 UPDATE 报文所需的会话信息
+type updateOptions struct {
+	localAS     uint32
+	ebgp        bool
+	fourOctetAS bool
+	nextHop     net.IP
+}
+
+// marshalUpdates 生成撤销 withdrawn 并通告 announced 的 UPDATE 报文, 前缀较多时拆分为多个报文
+func marshalUpdates(withdrawn, announced []*net.IPNet, opts updateOptions) [][]byte {
+	var msgs [][]byte
+
+	// 撤销的前缀不需要路径属性
+	for len(withdrawn) > 0 {
+		var prefixes []byte
+		withdrawn, prefixes = packPrefixes(withdrawn, maxMsgLen-headerLen-4)
+		body := make([]byte, 2, 4+len(prefixes))
+		binary.BigEndian.PutUint16(body, uint16(len(prefixes)))
+		body = append(body, prefixes...)
+		body = append(body, 0, 0)
+		msgs = append(msgs, marshalMessage(msgUpdate, body))
+	}
+
+	if len(announced) == 0 {
+		return msgs
+	}
+
+	attrs := pathAttributes(opts)
+	for len(announced) > 0 {
+		var prefixes []byte
+		announced, prefixes = packPrefixes(announced, maxMsgLen-headerLen-4-len(attrs))
+		body := make([]byte, 4, 4+len(attrs)+len(prefixes))
+		binary.BigEndian.PutUint16(body[2:4], uint16(len(attrs)))
+		body = append(body, attrs...)
+		body = append(body, prefixes...)
+		msgs = append(msgs, marshalMessage(msgUpdate, body))
+	}
+
+	return msgs
+}
+
+// pathAttributes 生成通告本节点前缀的路径属性, eBGP 时 AS_PATH 为本地 AS, iBGP 时为空并带有 LOCAL_PREF
+func pathAttributes(opts updateOptions) []byte {
+	attrs := []byte{attrFlagTransitive, attrOrigin, 1, originIGP}
+
+	if opts.ebgp {
+		if opts.fourOctetAS {
+			attrs = append(attrs, attrFlagTransitive, attrASPath, 6, asSequence, 1)
+			attrs = binary.BigEndian.AppendUint32(attrs, opts.localAS)
+		} else {
+			attrs = append(attrs, attrFlagTransitive, attrASPath, 4, asSequence, 1)
+			attrs = binary.BigEndian.AppendUint16(attrs, uint16(opts.localAS))
+		}
+	} else {
+		attrs = append(attrs, attrFlagTransitive, attrASPath, 0)
+	}
+
+	attrs = append(attrs, attrFlagTransitive, attrNextHop, 4)
+	attrs = append(attrs, opts.nextHop.To4()...)
+
+	if !opts.ebgp {
+		attrs = append(attrs, attrFlagTransitive, attrLocalPref, 4)
+		attrs = binary.BigEndian.AppendUint32(attrs, defaultLocalPref)
+	}
+
+	return attrs
+}
+
+// packPrefixes 将前缀编码为 NLRI, 最多使用 size 字节, 返回剩余的前缀
+func packPrefixes(prefixes []*net.IPNet, size int) ([]*net.IPNet, []byte) {
+	var b []byte
+	for len(prefixes) > 0 {
+		ones, _ := prefixes[0].Mask.Size()
+		n := (ones + 7) / 8
+		if len(b)+1+n > size {
+			break
+		}
+		b = append(b, byte(ones))
+		b = append(b, prefixes[0].IP.To4()[:n]...)
+		prefixes = prefixes[1:]
+	}
+
+	return prefixes, b
+}
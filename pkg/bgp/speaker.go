@@ -0,0 +1,361 @@
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultPort 是 BGP 的 TCP 端口
+	DefaultPort = 179
+	// DefaultHoldTime 是 OPEN 中声明的保持时间
+	DefaultHoldTime = 90 * time.Second
+
+	connectRetry = 10 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+var log = logf.Log.WithName("bgp")
+
+// PeerConfig 是 BGP 对端的配置
+type PeerConfig struct {
+	Address net.IP
+	Port    int
+	AS      uint32
+}
+
+// Speaker 是只通告路由的 BGP 发言者, 主动连接每个对端, 收到的路由被忽略
+type Speaker struct {
+	localAS  uint32
+	routerID net.IP
+	nextHop  net.IP
+	holdTime time.Duration
+	peers    []PeerConfig
+	notify   []chan struct{}
+
+	mu     sync.Mutex
+	groups map[string][]*net.IPNet // 按来源分组的通告前缀, 通告所有分组的并集
+}
+
+// ParsePeers 解析以逗号分隔的对端列表, 每个对端的格式为 <ip>[:port]/<as>
+func ParsePeers(s string) ([]PeerConfig, error) {
+	var peers []PeerConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, as, ok := strings.Cut(item, "/")
+		if !ok {
+			return nil, fmt.Errorf("bgp peer %q must be <ip>[:port]/<as>", item)
+		}
+
+		peer := PeerConfig{Port: DefaultPort}
+		host := addr
+		if h, port, err := net.SplitHostPort(addr); err == nil {
+			host = h
+			if peer.Port, err = strconv.Atoi(port); err != nil || peer.Port <= 0 || peer.Port > 65535 {
+				return nil, fmt.Errorf("invalid port of bgp peer %q", item)
+			}
+		}
+		if peer.Address = net.ParseIP(host).To4(); peer.Address == nil {
+			return nil, fmt.Errorf("invalid address of bgp peer %q", item)
+		}
+
+		n, err := strconv.ParseUint(as, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid as of bgp peer %q", item)
+		}
+		peer.AS = uint32(n)
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// NewSpeaker 创建 BGP 发言者, 通告的前缀以 nextHop 作为下一跳
+func NewSpeaker(localAS uint32, routerID, nextHop net.IP, peers []PeerConfig) *Speaker {
+	s := &Speaker{
+		localAS:  localAS,
+		routerID: routerID.To4(),
+		nextHop:  nextHop.To4(),
+		holdTime: DefaultHoldTime,
+		peers:    peers,
+		groups:   make(map[string][]*net.IPNet),
+	}
+	for range peers {
+		s.notify = append(s.notify, make(chan struct{}, 1))
+	}
+
+	return s
+}
+
+// SetRoutes 替换 group 中通告的前缀, 已经建立的会话随后发送 UPDATE
+func (s *Speaker) SetRoutes(group string, prefixes []*net.IPNet) {
+	s.mu.Lock()
+	s.groups[group] = prefixes
+	s.mu.Unlock()
+
+	for _, ch := range s.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// routes 返回所有分组通告的前缀
+func (s *Speaker) routes() map[string]*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make(map[string]*net.IPNet)
+	for _, prefixes := range s.groups {
+		for _, p := range prefixes {
+			if p.IP.To4() != nil {
+				routes[p.String()] = p
+			}
+		}
+	}
+
+	return routes
+}
+
+// Start 与所有对端建立会话, 会话断开后重新连接, 直到 ctx 结束
+func (s *Speaker) Start(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i, peer := range s.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runPeer(ctx, peer, s.notify[i])
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// runPeer 保持与对端的会话
+func (s *Speaker) runPeer(ctx context.Context, peer PeerConfig, notify chan struct{}) {
+	for {
+		err := s.session(ctx, peer, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error(err, "bgp session down", "peer", peer.Address.String(), "as", peer.AS)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// session 建立一次会话并通告前缀, 返回会话断开的原因
+func (s *Speaker) session(ctx context.Context, peer PeerConfig, notify chan struct{}) error {
+	dialer := net.Dialer{Timeout: connectRetry}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(peer.Address.String(), strconv.Itoa(peer.Port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// ctx 结束时发送 Cease 并关闭连接, 返回前等待 Cease 发送完成
+	ceased := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		write(conn, marshalNotification(errCease, errSubAdminDown))
+		conn.Close()
+		close(ceased)
+	})
+	defer func() {
+		if !stop() {
+			<-ceased
+		}
+	}()
+
+	if err := write(conn, marshalOpen(s.localAS, uint16(s.holdTime.Seconds()), s.routerID)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(s.holdTime))
+	msg, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msg.typ == msgNotification {
+		return parseNotification(msg.body)
+	}
+	if msg.typ != msgOpen {
+		return fmt.Errorf("unexpected message type %d in open sent", msg.typ)
+	}
+
+	open, err := parseOpen(msg.body)
+	if err != nil {
+		write(conn, marshalNotification(errOpenMessage, 0))
+		return err
+	}
+	if open.as != peer.AS {
+		write(conn, marshalNotification(errOpenMessage, errSubBadPeerAS))
+		return fmt.Errorf("peer as %d does not match configured as %d", open.as, peer.AS)
+	}
+	if !open.ipv4Unicast {
+		write(conn, marshalNotification(errOpenMessage, errSubUnsupportedCap))
+		return fmt.Errorf("peer does not support ipv4 unicast")
+	}
+	if s.localAS > 0xffff && !open.fourOctetAS {
+		write(conn, marshalNotification(errOpenMessage, errSubUnsupportedCap))
+		return fmt.Errorf("peer does not support four-octet as %d", s.localAS)
+	}
+
+	// 保持时间取双方声明的较小值, 为 0 时不发送 KEEPALIVE
+	hold := min(s.holdTime, time.Duration(open.holdTime)*time.Second)
+	if hold != 0 && hold < 3*time.Second {
+		write(conn, marshalNotification(errOpenMessage, errSubHoldTime))
+		return fmt.Errorf("unacceptable hold time %s", hold)
+	}
+
+	if err := write(conn, marshalMessage(msgKeepalive, nil)); err != nil {
+		return err
+	}
+
+	msgs := make(chan *message)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			if hold != 0 {
+				conn.SetReadDeadline(time.Now().Add(hold))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			msg, err := readMessage(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if hold != 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	opts := updateOptions{
+		localAS:     s.localAS,
+		ebgp:        peer.AS != s.localAS,
+		fourOctetAS: open.fourOctetAS,
+		nextHop:     s.nextHop,
+	}
+	established := false
+	advertised := make(map[string]*net.IPNet)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				write(conn, marshalNotification(errHoldTimer, 0))
+				return fmt.Errorf("hold timer expired")
+			}
+			return err
+		case <-keepalive:
+			if err := write(conn, marshalMessage(msgKeepalive, nil)); err != nil {
+				return err
+			}
+		case msg := <-msgs:
+			switch msg.typ {
+			case msgNotification:
+				return parseNotification(msg.body)
+			case msgKeepalive:
+				if !established {
+					established = true
+					log.Info("bgp session established", "peer", peer.Address.String(), "as", peer.AS, "router id", open.routerID.String())
+					if err := s.sync(conn, advertised, opts); err != nil {
+						return err
+					}
+				}
+			}
+		case <-notify:
+			if !established {
+				continue
+			}
+			if err := s.sync(conn, advertised, opts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sync 发送 UPDATE, 使对端收到的前缀与当前通告的前缀一致, advertised 记录已经通告的前缀
+func (s *Speaker) sync(conn net.Conn, advertised map[string]*net.IPNet, opts updateOptions) error {
+	routes := s.routes()
+
+	var withdrawn, announced []*net.IPNet
+	for key, p := range advertised {
+		if _, ok := routes[key]; !ok {
+			withdrawn = append(withdrawn, p)
+		}
+	}
+	for key, p := range routes {
+		if _, ok := advertised[key]; !ok {
+			announced = append(announced, p)
+		}
+	}
+	if len(withdrawn) == 0 && len(announced) == 0 {
+		return nil
+	}
+	sortPrefixes(withdrawn)
+	sortPrefixes(announced)
+
+	for _, msg := range marshalUpdates(withdrawn, announced, opts) {
+		if err := write(conn, msg); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range withdrawn {
+		delete(advertised, p.String())
+	}
+	for _, p := range announced {
+		advertised[p.String()] = p
+	}
+	log.Info("bgp update sent", "withdrawn", withdrawn, "announced", announced)
+
+	return nil
+}
+
+// write 发送报文, 对端不读取时超时返回
+func write(conn net.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(msg)
+	return err
+}
+
+// sortPrefixes 按字符串排序前缀, 使 UPDATE 的内容稳定
+func sortPrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].String() < prefixes[j].String()
+	})
+}
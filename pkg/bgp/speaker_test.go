@@ -0,0 +1,178 @@
+package bgp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testUpdate 是测试中解析的 UPDATE 报文
+type testUpdate struct {
+	withdrawn []string
+	announced []string
+	nextHop   net.IP
+	asPath    []byte
+}
+
+// parseTestUpdate 解析 UPDATE 报文中的撤销前缀、通告前缀、NEXT_HOP 和 AS_PATH
+func parseTestUpdate(t *testing.T, body []byte) *testUpdate {
+	t.Helper()
+
+	u := &testUpdate{}
+	wl := int(binary.BigEndian.Uint16(body[0:2]))
+	u.withdrawn = parseTestPrefixes(t, body[2:2+wl])
+
+	body = body[2+wl:]
+	al := int(binary.BigEndian.Uint16(body[0:2]))
+	attrs := body[2 : 2+al]
+	for len(attrs) >= 3 {
+		typ, l := attrs[1], int(attrs[2])
+		value := attrs[3 : 3+l]
+		switch typ {
+		case attrNextHop:
+			u.nextHop = net.IP(value)
+		case attrASPath:
+			u.asPath = value
+		}
+		attrs = attrs[3+l:]
+	}
+	u.announced = parseTestPrefixes(t, body[2+al:])
+
+	return u
+}
+
+// parseTestPrefixes 解析 NLRI 编码的前缀
+func parseTestPrefixes(t *testing.T, b []byte) []string {
+	t.Helper()
+
+	var prefixes []string
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if len(b) < 1+n {
+			t.Fatalf("invalid nlri %v", b)
+		}
+		ip := make(net.IP, 4)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String())
+		b = b[1+n:]
+	}
+
+	return prefixes
+}
+
+// expectMessage 读取下一个报文并检查类型
+func expectMessage(t *testing.T, conn net.Conn, typ byte) *message {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readMessage(conn)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if msg.typ != typ {
+		t.Fatalf("got message type %d, want %d", msg.typ, typ)
+	}
+
+	return msg
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ipNet
+}
+
+func TestSpeaker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	nextHop := net.ParseIP("10.0.0.1")
+	peer := PeerConfig{Address: net.ParseIP("127.0.0.1"), Port: ln.Addr().(*net.TCPAddr).Port, AS: 64513}
+	speaker := NewSpeaker(64512, nextHop, nextHop, []PeerConfig{peer})
+	speaker.SetRoutes("node", []*net.IPNet{mustParseCIDR(t, "10.244.1.0/24")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		speaker.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("speaker did not connect: %v", err)
+	}
+	defer conn.Close()
+
+	// 发言者先发送 OPEN
+	open, err := parseOpen(expectMessage(t, conn, msgOpen).body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open.as != 64512 || !open.routerID.Equal(nextHop) || !open.fourOctetAS || !open.ipv4Unicast {
+		t.Fatalf("unexpected open %+v", open)
+	}
+
+	if _, err := conn.Write(marshalOpen(64513, 90, net.ParseIP("10.0.0.254"))); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, conn, msgKeepalive)
+
+	// 收到 KEEPALIVE 后会话建立, 发言者通告当前的前缀
+	if _, err := conn.Write(marshalMessage(msgKeepalive, nil)); err != nil {
+		t.Fatal(err)
+	}
+	u := parseTestUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if u.withdrawn != nil || !reflect.DeepEqual(u.announced, []string{"10.244.1.0/24"}) {
+		t.Fatalf("unexpected update %+v", u)
+	}
+	if !u.nextHop.Equal(nextHop) {
+		t.Fatalf("got next hop %s, want %s", u.nextHop, nextHop)
+	}
+	// eBGP 的 AS_PATH 为本地 AS
+	if want := []byte{asSequence, 1, 0, 0, 0xfc, 0x00}; !reflect.DeepEqual(u.asPath, want) {
+		t.Fatalf("got as path %v, want %v", u.asPath, want)
+	}
+
+	// 替换前缀时先撤销旧的前缀再通告新的前缀
+	speaker.SetRoutes("node", []*net.IPNet{mustParseCIDR(t, "10.244.2.0/24")})
+	u = parseTestUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if !reflect.DeepEqual(u.withdrawn, []string{"10.244.1.0/24"}) || u.announced != nil {
+		t.Fatalf("unexpected withdraw %+v", u)
+	}
+	u = parseTestUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if u.withdrawn != nil || !reflect.DeepEqual(u.announced, []string{"10.244.2.0/24"}) {
+		t.Fatalf("unexpected update %+v", u)
+	}
+
+	// 清空分组后撤销所有前缀
+	speaker.SetRoutes("node", nil)
+	u = parseTestUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if !reflect.DeepEqual(u.withdrawn, []string{"10.244.2.0/24"}) || u.announced != nil {
+		t.Fatalf("unexpected withdraw %+v", u)
+	}
+
+	// 停止时发送 Cease
+	cancel()
+	err = parseNotification(expectMessage(t, conn, msgNotification).body)
+	if n, ok := err.(*notificationError); !ok || n.code != errCease || n.subcode != errSubAdminDown {
+		t.Fatalf("got %v, want cease administrative shutdown", err)
+	}
+}
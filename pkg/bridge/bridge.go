@@ -1,10 +1,13 @@
 package bridge
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"os"
+	"syscall"
 
+	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -12,34 +15,54 @@ import (
 )
 
 // CreateBridge 创建一个桥接设备
-func CreateBridge(bridge string, mtu int, gateway net.IPNet) (netlink.Link, error) {
-	// 检查是否存在同名桥接
-	if l, _ := netlink.LinkByName(bridge); l != nil {
-		return l, nil
-	}
+func CreateBridge(bridge string, mtu int, gateway net.IPNet, promiscMode bool) (netlink.Link, error) {
+	// 检查是否存在同名桥接, 不存在则创建
+	dev, err := netlink.LinkByName(bridge)
+	if err != nil {
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   bridge, // 设定桥接名称
+				MTU:    mtu,    // 设置MTU
+				TxQLen: -1,     // 设置队列长度
+			},
+		}
+
+		// 创建桥接
+		if err := netlink.LinkAdd(br); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+
+		// 获取桥接设备
+		dev, err = netlink.LinkByName(bridge)
+		if err != nil {
+			return nil, err
+		}
 
-	br := &netlink.Bridge{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:   bridge, // 设定桥接名称
-			MTU:    mtu,    // 设置MTU
-			TxQLen: -1,     // 设置队列长度
-		},
+		// 固定网桥的 MAC 地址, 避免随着 veth 的加入和移除而变化
+		if err = netlink.LinkSetHardwareAddr(dev, dev.Attrs().HardwareAddr); err != nil {
+			return nil, err
+		}
 	}
 
-	// 创建桥接
-	if err := netlink.LinkAdd(br); err != nil {
-		return nil, err
+	// 网桥已存在时, 更新为期望的 MTU
+	if mtu > 0 && dev.Attrs().MTU != mtu {
+		if err = netlink.LinkSetMTU(dev, mtu); err != nil {
+			return nil, err
+		}
 	}
 
-	// 获取桥接设备
-	dev, err := netlink.LinkByName(bridge)
-	if err != nil {
-		return nil, err
+	// 设置网关, 网桥可能由 raccoond 预先创建而没有网关地址
+	if gateway.IP != nil {
+		if err = netlink.AddrAdd(dev, &netlink.Addr{IPNet: &gateway}); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
 	}
 
-	// 设置网关
-	if err = netlink.AddrAdd(dev, &netlink.Addr{IPNet: &gateway}); err != nil {
-		return nil, err
+	// 开启混杂模式
+	if promiscMode {
+		if err = netlink.SetPromiscOn(dev); err != nil {
+			return nil, err
+		}
 	}
 
 	// 启动桥接
@@ -50,29 +73,61 @@ func CreateBridge(bridge string, mtu int, gateway net.IPNet) (netlink.Link, erro
 	return dev, nil
 }
 
-// SetupVethPair 创建一个 veth pair
-func SetupVethPair(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) error {
+// HostVethName 根据容器 ID 和容器网卡名称生成宿主机端 veth 的名称, 网络命名空间被删除后仍然可以找到宿主机端网卡
+func HostVethName(containerID, ifName string) string {
+	// 网卡名称最长为 15 个字符
+	return fmt.Sprintf("veth%x", sha256.Sum256([]byte(containerID+"/"+ifName)))[:15]
+}
+
+// PodMAC 根据容器 IPv4 地址生成本地管理的单播 MAC 地址 0a:58:xx:xx:xx:xx
+func PodMAC(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+
+	return net.HardwareAddr{0x0a, 0x58, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
+
+// SetupVethPair 创建一个 veth pair, podIP 为空时不配置地址, gateway 为空时不添加默认路由, 返回宿主机端和容器端网卡
+// mac 为空时容器端网卡使用随机的 MAC 地址
+func SetupVethPair(netns ns.NetNS, br netlink.Link, mtu int, ifName, hostVethName, mac string, podIP *net.IPNet, gateway net.IP, hairpinMode bool) (*current.Interface, *current.Interface, error) {
 	hostInterface := &current.Interface{}
+	containerInterface := &current.Interface{}
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostVethName, mtu, mac, hostNS)
 		if err != nil {
 			return err
 		}
 		hostInterface.Name = hostVeth.Name
+		hostInterface.Mac = hostVeth.HardwareAddr.String()
+		containerInterface.Name = containerVeth.Name
+		containerInterface.Mac = containerVeth.HardwareAddr.String()
+		containerInterface.Sandbox = netns.Path()
 
 		conLink, err := netlink.LinkByName(containerVeth.Name)
 		if err != nil {
 			return err
 		}
-		if err := netlink.AddrAdd(conLink, &netlink.Addr{IPNet: podIP}); err != nil {
+
+		if err = netlink.LinkSetUp(conLink); err != nil {
 			return err
 		}
 
-		if err = netlink.LinkSetUp(conLink); err != nil {
+		// 地址配置在其他网卡上时, 例如 tap 模式
+		if podIP == nil {
+			return nil
+		}
+
+		if err := netlink.AddrAdd(conLink, &netlink.Addr{IPNet: podIP}); err != nil {
 			return err
 		}
 
+		if gateway == nil {
+			return nil
+		}
+
 		if err = ip.AddDefaultRoute(gateway, conLink); err != nil {
 			return err
 		}
@@ -81,58 +136,466 @@ func SetupVethPair(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podI
 	})
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	hostVeth, err := netlink.LinkByName(hostInterface.Name)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
 	}
 
 	if hostVeth == nil {
-		return fmt.Errorf("nil hostveth")
+		return nil, nil, fmt.Errorf("nil hostveth")
 	}
 
 	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
 	}
 
-	return nil
+	if hairpinMode {
+		if err = netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to setup hairpin mode for %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+
+	return hostInterface, containerInterface, nil
 }
 
-// DelVethPair 删除一个 veth pair
-func DelVethPair(netns ns.NetNS, ifName string) error {
-	return netns.Do(func(ns.NetNS) error {
-		l, err := netlink.LinkByName(ifName)
-		if os.IsNotExist(err) {
+// AttachVeth 将容器中已经存在的 veth 接入网桥, 用于作为链式插件处理 prevResult 中的网卡
+// podIP 为空时不添加地址, gateway 为空时不添加默认路由, 返回宿主机端网卡
+func AttachVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP *net.IPNet, gateway net.IP, hairpinMode bool) (*current.Interface, error) {
+	peerIndex := 0
+
+	err := netns.Do(func(ns.NetNS) error {
+		conLink, index, err := ip.GetVethPeerIfindex(ifName)
+		if err != nil {
+			return err
+		}
+		peerIndex = index
+
+		if err = netlink.LinkSetMTU(conLink, mtu); err != nil {
+			return fmt.Errorf("failed to set mtu of %q: %v", ifName, err)
+		}
+
+		if podIP != nil {
+			if err = netlink.AddrAdd(conLink, &netlink.Addr{IPNet: podIP}); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add address %s to %q: %v", podIP, ifName, err)
+			}
+		}
+
+		if err = netlink.LinkSetUp(conLink); err != nil {
+			return err
+		}
+
+		if gateway == nil {
 			return nil
 		}
+
+		// 替换之前的插件添加的默认路由
+		return netlink.RouteReplace(&netlink.Route{LinkIndex: conLink.Attrs().Index, Gw: gateway})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find peer of %q: %v", ifName, err)
+	}
+
+	if err = netlink.LinkSetMTU(hostVeth, mtu); err != nil {
+		return nil, fmt.Errorf("failed to set mtu of %q: %v", hostVeth.Attrs().Name, err)
+	}
+
+	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+
+	if hairpinMode {
+		if err = netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return nil, fmt.Errorf("failed to setup hairpin mode for %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+
+	if err = netlink.LinkSetUp(hostVeth); err != nil {
+		return nil, err
+	}
+
+	return &current.Interface{Name: hostVeth.Attrs().Name, Mac: hostVeth.Attrs().HardwareAddr.String()}, nil
+}
+
+// DetachVeth 将 AttachVeth 接入的 veth 从网桥中移除, podIP 不为空时删除容器端网卡的地址
+func DetachVeth(netns ns.NetNS, ifName string, podIP *net.IPNet) error {
+	peerIndex := 0
+
+	err := netns.Do(func(ns.NetNS) error {
+		conLink, index, err := ip.GetVethPeerIfindex(ifName)
 		if err != nil {
 			return err
 		}
-		return netlink.LinkDel(l)
+		peerIndex = index
+
+		if podIP == nil {
+			return nil
+		}
+
+		if err = netlink.AddrDel(conLink, &netlink.Addr{IPNet: podIP}); err != nil && err != syscall.EADDRNOTAVAIL {
+			return err
+		}
+
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil
+	}
+
+	return netlink.LinkSetNoMaster(hostVeth)
 }
 
-// CheckVethPair 检查一个 veth pair 是否存在
-func CheckVethPair(netns ns.NetNS, ifName string, ip net.IP) error {
-	return netns.Do(func(ns.NetNS) error {
-		l, err := netlink.LinkByName(ifName)
+// DelVethPair 删除一个 veth pair, 网卡不存在时直接返回
+// netns 为空说明网络命名空间已经被删除, 此时根据 hostVethName 清理宿主机端网卡
+// chained 表示 veth 由之前的插件创建, 只将其从网桥中移除
+func DelVethPair(netns ns.NetNS, ifName, hostVethName string, chained bool) error {
+	if netns != nil {
+		// 通过容器端网卡的 peer index 找到宿主机端网卡
+		peerIndex := 0
+		err := netns.Do(func(ns.NetNS) error {
+			if _, err := netlink.LinkByName(ifName); err != nil {
+				if _, ok := err.(netlink.LinkNotFoundError); ok {
+					return nil
+				}
+				return err
+			}
+
+			_, index, err := ip.GetVethPeerIfindex(ifName)
+			if err != nil {
+				// 不是 veth 时直接删除容器端网卡
+				return ip.DelLinkByName(ifName)
+			}
+			peerIndex = index
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// 按 peer index 删除, 宿主机端网卡的名称可能与 hostVethName 不同, 例如按照旧的规则命名的网卡
+		if peerIndex > 0 {
+			l, err := netlink.LinkByIndex(peerIndex)
+			if err == nil {
+				if chained {
+					return netlink.LinkSetNoMaster(l)
+				}
+				return netlink.LinkDel(l)
+			}
+			if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+
+	// 没有宿主机端网卡, 例如 macvlan 和 ipvlan 模式
+	if hostVethName == "" {
+		return nil
+	}
+
+	// 删除宿主机端网卡会同时删除容器端网卡
+	if err := ip.DelLinkByName(hostVethName); err != nil && err != ip.ErrLinkNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// LinkExists 判断容器端网卡或宿主机端网卡是否已经存在, 已经存在时网卡不是由本次 ADD 创建的
+func LinkExists(netns ns.NetNS, ifName, hostVethName string) (bool, error) {
+	if hostVethName != "" {
+		_, err := netlink.LinkByName(hostVethName)
+		if err == nil {
+			return true, nil
+		}
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return false, err
+		}
+	}
+
+	exists := false
+	err := netns.Do(func(ns.NetNS) error {
+		_, err := netlink.LinkByName(ifName)
+		if err == nil {
+			exists = true
+			return nil
+		}
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	})
+
+	return exists, err
+}
+
+// CheckVethPair 根据 prevResult 检查容器端网卡的 MAC、MTU、地址和路由, 返回宿主机端网卡的 index
+// gateway 为空时不检查默认路由
+func CheckVethPair(netns ns.NetNS, ifName string, mtu int, result *current.Result, gateway net.IP) (int, error) {
+	peerIndex := 0
+
+	err := netns.Do(func(ns.NetNS) error {
+		if err := checkInterface(ifName, mtu, result, gateway); err != nil {
+			return err
+		}
+
+		_, index, err := ip.GetVethPeerIfindex(ifName)
+		peerIndex = index
+		return err
+	})
+
+	return peerIndex, err
+}
+
+// checkInterface 在当前网络命名空间中根据 prevResult 检查网卡的 MAC、MTU、地址和路由
+func checkInterface(ifName string, mtu int, result *current.Result, gateway net.IP) error {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %q: %v", ifName, err)
+	}
+
+	// 检查 MAC 地址
+	ifIndex := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name != ifName || iface.Sandbox == "" {
+			continue
+		}
+		ifIndex = i
+
+		if iface.Mac != "" && iface.Mac != l.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("interface %q has mac %s, expected %s", ifName, l.Attrs().HardwareAddr, iface.Mac)
+		}
+	}
+
+	// 检查 MTU
+	if l.Attrs().MTU != mtu {
+		return fmt.Errorf("interface %q has mtu %d, expected %d", ifName, l.Attrs().MTU, mtu)
+	}
+
+	// 检查地址和掩码
+	addrs, err := netlink.AddrList(l, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface != ifIndex {
+			continue
+		}
+		if !containsAddr(addrs, ipc.Address) {
+			return fmt.Errorf("interface %q is missing address %s", ifName, ipc.Address.String())
+		}
+	}
+
+	// 检查经由网关的默认路由
+	if gateway != nil {
+		routes, err := netlink.RouteList(l, netlink.FAMILY_V4)
 		if err != nil {
 			return err
 		}
+		if !containsDefaultRoute(routes, gateway) {
+			return fmt.Errorf("interface %q is missing default route via %s", ifName, gateway)
+		}
+	}
+
+	// 检查 prevResult 中的其他路由
+	return ip.ValidateExpectedRoute(result.Routes)
+}
+
+// CheckBridge 检查宿主机端网卡是否连接到网桥, 以及网桥是否有网关地址
+func CheckBridge(bridge string, hostVethIndex, mtu int, gateway *net.IPNet, result *current.Result) error {
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %q: %v", bridge, err)
+	}
+
+	hostVeth, err := netlink.LinkByIndex(hostVethIndex)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth with index %d: %v", hostVethIndex, err)
+	}
+
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("host veth %q is not attached to bridge %q", hostVeth.Attrs().Name, bridge)
+	}
+
+	if hostVeth.Attrs().MTU != mtu {
+		return fmt.Errorf("host veth %q has mtu %d, expected %d", hostVeth.Attrs().Name, hostVeth.Attrs().MTU, mtu)
+	}
+
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	if !containsAddr(addrs, *gateway) {
+		return fmt.Errorf("bridge %q is missing gateway address %s", bridge, gateway.String())
+	}
+
+	// 检查 prevResult 中宿主机端网卡的 MAC 地址
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" || iface.Mac == "" {
+			continue
+		}
+
+		var l netlink.Link
+		switch iface.Name {
+		case bridge:
+			l = br
+		case hostVeth.Attrs().Name:
+			l = hostVeth
+		default:
+			continue
+		}
 
-		ips, err := netlink.AddrList(l, netlink.FAMILY_V4)
+		if iface.Mac != l.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("interface %q has mac %s, expected %s", iface.Name, l.Attrs().HardwareAddr, iface.Mac)
+		}
+	}
+
+	return nil
+}
+
+// containsAddr 判断地址列表中是否包含指定的地址和掩码
+func containsAddr(addrs []netlink.Addr, ipn net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ipn.IP) && addr.Mask.String() == ipn.Mask.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsDefaultRoute 判断路由列表中是否包含经由网关的默认路由
+func containsDefaultRoute(routes []netlink.Route, gateway net.IP) bool {
+	for _, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if route.Gw.Equal(gateway) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddRoutes 在容器中为网卡添加路由, 路由没有指定网关时经由 gateway
+func AddRoutes(netns ns.NetNS, ifName string, routes []*types.Route, gateway net.IP) error {
+	return netns.Do(func(ns.NetNS) error {
+		l, err := netlink.LinkByName(ifName)
 		if err != nil {
 			return err
 		}
 
-		for _, addr := range ips {
-			if addr.IP.Equal(ip) {
-				return nil
+		for _, route := range routes {
+			gw := route.GW
+			if gw == nil {
+				gw = gateway
+			}
+
+			dst := route.Dst
+			if err := ip.AddRoute(&dst, gw, l); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add route %s via %s: %v", dst.String(), gw, err)
 			}
 		}
 
-		return fmt.Errorf("failed to find ip %s for %s", ip, ifName)
+		return nil
 	})
 }
+
+// LinkByIP 查找配置了指定地址的网卡, raccoond 通过节点的 InternalIP 找到宿主机网卡
+func LinkByIP(hostIP net.IP) (netlink.Link, error) {
+	linkList, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range linkList {
+		if link.Attrs() == nil {
+			continue
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(hostIP) {
+				return link, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find link with address %s", hostIP)
+}
+
+// HostVethByIP 根据宿主机上的路由和邻居表查找 Pod 地址对应的宿主机端 veth, 用于存储中没有记录 veth 的 Pod
+// ptp 模式下到 Pod 地址的路由经由 veth, bridge 模式下根据网桥上的 ARP 表项和 FDB 表项找到 Pod 的 MAC 地址所在的端口
+func HostVethByIP(podIP net.IP) (string, error) {
+	routes, err := netlink.RouteGet(podIP)
+	if err != nil {
+		return "", err
+	}
+	if len(routes) == 0 {
+		return "", fmt.Errorf("no route to %s", podIP)
+	}
+
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return "", err
+	}
+	switch link.(type) {
+	case *netlink.Veth:
+		return link.Attrs().Name, nil
+	case *netlink.Bridge:
+	default:
+		return "", fmt.Errorf("%s is routed via %s %q", podIP, link.Type(), link.Attrs().Name)
+	}
+
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	var mac net.HardwareAddr
+	for _, n := range neighs {
+		if n.IP.Equal(podIP) && len(n.HardwareAddr) > 0 {
+			mac = n.HardwareAddr
+			break
+		}
+	}
+	if mac == nil {
+		return "", fmt.Errorf("no neighbor entry for %s on %q", podIP, link.Attrs().Name)
+	}
+
+	fdb, err := netlink.NeighList(0, syscall.AF_BRIDGE)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range fdb {
+		if n.MasterIndex != link.Attrs().Index || n.HardwareAddr.String() != mac.String() {
+			continue
+		}
+		port, err := netlink.LinkByIndex(n.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := port.(*netlink.Veth); ok {
+			return port.Attrs().Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no port of %q has %s", link.Attrs().Name, mac)
+}
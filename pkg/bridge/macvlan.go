@@ -0,0 +1,168 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// SetupMacvlan 在 master 上创建 bridge 模式的 macvlan 子接口并移入容器, 返回容器端网卡
+func SetupMacvlan(netns ns.NetNS, master string, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) (*current.Interface, error) {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	mv := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: netlink.MACVLAN_MODE_BRIDGE,
+	}
+
+	return setupSubInterface(netns, mv, ifName, podIP, gateway, false)
+}
+
+// SetupIPvlan 在 master 上创建 ipvlan 子接口并移入容器, 返回容器端网卡
+// l3 模式下容器不处理 ARP, 默认路由直接经由网卡而不经过网关
+func SetupIPvlan(netns ns.NetNS, master string, l3 bool, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) (*current.Interface, error) {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	mode := netlink.IPVLAN_MODE_L2
+	if l3 {
+		mode = netlink.IPVLAN_MODE_L3
+	}
+
+	iv := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+
+	return setupSubInterface(netns, iv, ifName, podIP, gateway, l3)
+}
+
+// UnderlayNetwork 返回 master 上 IPv4 地址所在的网段, 以及经由 master 的默认路由的网关, 没有默认路由时网关为 nil
+func UnderlayNetwork(master string) (*net.IPNet, net.IP, error) {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	addrs, err := netlink.AddrList(m, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("master %q has no ipv4 address", master)
+	}
+	network := &net.IPNet{IP: addrs[0].IP.Mask(addrs[0].Mask), Mask: addrs[0].Mask}
+
+	routes, err := netlink.RouteList(m, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, route := range routes {
+		if route.Gw != nil && (route.Dst == nil || route.Dst.IP.IsUnspecified()) {
+			return network, route.Gw, nil
+		}
+	}
+
+	return network, nil, nil
+}
+
+// setupSubInterface 创建子接口并直接放入容器的网络命名空间, 重命名后配置地址和路由
+func setupSubInterface(netns ns.NetNS, link netlink.Link, ifName string, podIP *net.IPNet, gateway net.IP, devRoute bool) (*current.Interface, error) {
+	// 先使用临时名称创建, 避免与宿主机上的网卡重名
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+	link.Attrs().Name = tmpName
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", link.Type(), err)
+	}
+
+	containerInterface := &current.Interface{Sandbox: netns.Path()}
+
+	err = netns.Do(func(ns.NetNS) error {
+		if err := ip.RenameLink(tmpName, ifName); err != nil {
+			_ = ip.DelLinkByName(tmpName)
+			return fmt.Errorf("failed to rename %s to %q: %v", link.Type(), ifName, err)
+		}
+
+		conLink, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		containerInterface.Name = ifName
+		containerInterface.Mac = conLink.Attrs().HardwareAddr.String()
+
+		if err := netlink.AddrAdd(conLink, &netlink.Addr{IPNet: podIP}); err != nil {
+			return err
+		}
+
+		if err = netlink.LinkSetUp(conLink); err != nil {
+			return err
+		}
+
+		if gateway == nil {
+			return nil
+		}
+
+		// 不处理 ARP 时默认路由直接经由网卡
+		if devRoute {
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: conLink.Attrs().Index, Scope: netlink.SCOPE_LINK})
+		}
+
+		return ip.AddDefaultRoute(gateway, conLink)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return containerInterface, nil
+}
+
+// CheckSubInterface 根据 prevResult 检查容器中的 macvlan 或 ipvlan 子接口, 以及它是否创建在 master 上
+// gateway 为空时不检查默认路由
+func CheckSubInterface(netns ns.NetNS, ifName, linkType, master string, mtu int, result *current.Result, gateway net.IP) error {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	return netns.Do(func(ns.NetNS) error {
+		if err := checkInterface(ifName, mtu, result, gateway); err != nil {
+			return err
+		}
+
+		l, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+
+		if l.Type() != linkType {
+			return fmt.Errorf("interface %q is %s, expected %s", ifName, l.Type(), linkType)
+		}
+
+		if l.Attrs().ParentIndex != m.Attrs().Index {
+			return fmt.Errorf("interface %q is not created on master %q", ifName, master)
+		}
+
+		return nil
+	})
+}
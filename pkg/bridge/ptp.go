@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+// PTPGateway 是 ptp 模式下容器的网关, 由宿主机端 veth 通过 proxy ARP 应答
+var PTPGateway = net.IPv4(169, 254, 1, 1)
+
+// SetupPTP 创建一个不接入网桥的 veth pair, 容器通过 proxy ARP 访问 PTPGateway
+// 宿主机上添加一条经由宿主机端 veth 到容器的 /32 路由, 返回宿主机端和容器端网卡, mac 为空时使用随机的 MAC 地址
+func SetupPTP(netns ns.NetNS, mtu int, ifName, hostVethName, mac string, podIP net.IP, defaultRoute bool) (*current.Interface, *current.Interface, error) {
+	hostInterface := &current.Interface{}
+	containerInterface := &current.Interface{}
+
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostVethName, mtu, mac, hostNS)
+		if err != nil {
+			return err
+		}
+		hostInterface.Name = hostVeth.Name
+		hostInterface.Mac = hostVeth.HardwareAddr.String()
+		containerInterface.Name = containerVeth.Name
+		containerInterface.Mac = containerVeth.HardwareAddr.String()
+		containerInterface.Sandbox = netns.Path()
+
+		conLink, err := netlink.LinkByName(containerVeth.Name)
+		if err != nil {
+			return err
+		}
+
+		// 容器中只有一个 /32 地址, 不与其他容器共享二层
+		if err := netlink.AddrAdd(conLink, &netlink.Addr{IPNet: hostNet(podIP)}); err != nil {
+			return err
+		}
+
+		if err = netlink.LinkSetUp(conLink); err != nil {
+			return err
+		}
+
+		// 网关不在容器的子网中, 需要先添加一条到网关的链路路由
+		if err = addLinkRoute(PTPGateway, conLink); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", PTPGateway, err)
+		}
+
+		if !defaultRoute {
+			return nil
+		}
+
+		if err = ip.AddDefaultRoute(PTPGateway, conLink); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostVeth, err := netlink.LinkByName(hostInterface.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+	}
+
+	// 宿主机端 veth 代替网关应答容器的 ARP 请求
+	if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", hostInterface.Name), "1"); err != nil {
+		return nil, nil, fmt.Errorf("failed to enable proxy arp on %q: %v", hostInterface.Name, err)
+	}
+
+	if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv4/neigh/%s/proxy_delay", hostInterface.Name), "0"); err != nil {
+		return nil, nil, fmt.Errorf("failed to set proxy delay on %q: %v", hostInterface.Name, err)
+	}
+
+	if err = addLinkRoute(podIP, hostVeth); err != nil {
+		return nil, nil, fmt.Errorf("failed to add route to %s: %v", podIP, err)
+	}
+
+	return hostInterface, containerInterface, nil
+}
+
+// CheckPTP 检查宿主机端 veth 没有接入网桥, 开启了 proxy ARP, 并且有到容器的 /32 路由
+func CheckPTP(hostVethIndex, mtu int, podIP net.IP) error {
+	hostVeth, err := netlink.LinkByIndex(hostVethIndex)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth with index %d: %v", hostVethIndex, err)
+	}
+	name := hostVeth.Attrs().Name
+
+	if hostVeth.Attrs().MasterIndex != 0 {
+		return fmt.Errorf("host veth %q is attached to a bridge in ptp mode", name)
+	}
+
+	if hostVeth.Attrs().MTU != mtu {
+		return fmt.Errorf("host veth %q has mtu %d, expected %d", name, hostVeth.Attrs().MTU, mtu)
+	}
+
+	proxyARP, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", name))
+	if err != nil {
+		return err
+	}
+	if proxyARP != "1" {
+		return fmt.Errorf("proxy arp is disabled on host veth %q", name)
+	}
+
+	routes, err := netlink.RouteList(hostVeth, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() == hostNet(podIP).String() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("host veth %q is missing route to %s", name, podIP)
+}
+
+// addLinkRoute 添加一条经由网卡直达的 /32 路由
+func addLinkRoute(dst net.IP, link netlink.Link) error {
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       hostNet(dst),
+	})
+}
+
+// hostNet 返回只包含一个地址的网段
+func hostNet(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
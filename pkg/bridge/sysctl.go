@@ -0,0 +1,35 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// SetSysctls 在容器的网络命名空间中设置 sysctl, key 使用 net.core.somaxconn 的格式
+func SetSysctls(netns ns.NetNS, ifName string, sysctls map[string]string) error {
+	if len(sysctls) == 0 {
+		return nil
+	}
+
+	return netns.Do(func(ns.NetNS) error {
+		for k, v := range sysctls {
+			if _, err := sysctl.Sysctl(sysctlPath(k, ifName), v); err != nil {
+				return fmt.Errorf("failed to set sysctl %s=%s: %v", k, v, err)
+			}
+		}
+		return nil
+	})
+}
+
+// sysctlPath 将 sysctl 转换为 /proc/sys 下的路径, 容器网卡名称中的 "." 保持不变
+func sysctlPath(key, ifName string) string {
+	segment := "." + ifName + "."
+	if i := strings.Index(key, segment); i >= 0 {
+		return strings.ReplaceAll(key[:i], ".", "/") + "/" + ifName + "/" + strings.ReplaceAll(key[i+len(segment):], ".", "/")
+	}
+
+	return strings.ReplaceAll(key, ".", "/")
+}
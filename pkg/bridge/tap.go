@@ -0,0 +1,148 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// SetupTap 在容器中创建 tap 设备并连接到容器端 veth, 地址、MAC 和默认路由配置在 tap 上
+// 虚拟机运行时从 tap 上读取网络配置并交给虚拟机, gateway 为空时不添加默认路由
+// macvtap 为 true 时在 veth 上创建 passthru 模式的 macvtap, 否则创建 tap 并通过 tc 与 veth 双向重定向
+func SetupTap(netns ns.NetNS, vethName, tapName string, macvtap bool, mtu int, podIP *net.IPNet, gateway net.IP) (*current.Interface, error) {
+	tapInterface := &current.Interface{Name: tapName, Sandbox: netns.Path()}
+
+	err := netns.Do(func(ns.NetNS) error {
+		veth, err := netlink.LinkByName(vethName)
+		if err != nil {
+			return err
+		}
+
+		var tap netlink.Link
+		if macvtap {
+			tap = &netlink.Macvtap{
+				Macvlan: netlink.Macvlan{
+					LinkAttrs: netlink.LinkAttrs{
+						Name:        tapName,
+						MTU:         mtu,
+						ParentIndex: veth.Attrs().Index,
+					},
+					Mode: netlink.MACVLAN_MODE_PASSTHRU,
+				},
+			}
+		} else {
+			tap = &netlink.Tuntap{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: tapName,
+					MTU:  mtu,
+				},
+				Mode:  netlink.TUNTAP_MODE_TAP,
+				Flags: netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+			}
+		}
+
+		if err = netlink.LinkAdd(tap); err != nil {
+			return fmt.Errorf("failed to create tap %q: %v", tapName, err)
+		}
+
+		if tap, err = netlink.LinkByName(tapName); err != nil {
+			return err
+		}
+
+		// 创建 tuntap 只使用 ioctl, 不会设置 LinkAttrs 中的 MTU
+		if tap.Attrs().MTU != mtu {
+			if err = netlink.LinkSetMTU(tap, mtu); err != nil {
+				return fmt.Errorf("failed to set mtu of tap %q: %v", tapName, err)
+			}
+		}
+
+		// tc 重定向时虚拟机使用容器端 veth 的 MAC 地址, passthru 模式的 macvtap 本身继承 veth 的 MAC 地址
+		if !macvtap {
+			if err = netlink.LinkSetHardwareAddr(tap, veth.Attrs().HardwareAddr); err != nil {
+				return err
+			}
+			tapInterface.Mac = veth.Attrs().HardwareAddr.String()
+		} else {
+			tapInterface.Mac = tap.Attrs().HardwareAddr.String()
+		}
+
+		if err = netlink.LinkSetUp(tap); err != nil {
+			return err
+		}
+
+		if !macvtap {
+			if err = addRedirect(veth, tap); err != nil {
+				return err
+			}
+			if err = addRedirect(tap, veth); err != nil {
+				return err
+			}
+		}
+
+		if err = netlink.AddrAdd(tap, &netlink.Addr{IPNet: podIP}); err != nil {
+			return err
+		}
+
+		if gateway == nil {
+			return nil
+		}
+
+		return ip.AddDefaultRoute(gateway, tap)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tapInterface, nil
+}
+
+// DelTap 删除容器中的 tap 设备, 网卡不存在时直接返回
+func DelTap(netns ns.NetNS, tapName string) error {
+	return netns.Do(func(ns.NetNS) error {
+		if err := ip.DelLinkByName(tapName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// CheckTap 根据 prevResult 检查容器中 tap 设备的 MAC、MTU、地址和路由, gateway 为空时不检查默认路由
+func CheckTap(netns ns.NetNS, tapName string, mtu int, result *current.Result, gateway net.IP) error {
+	return netns.Do(func(ns.NetNS) error {
+		return checkInterface(tapName, mtu, result, gateway)
+	})
+}
+
+// addRedirect 将 from 收到的所有报文重定向到 to 发出
+func addRedirect(from, to netlink.Link) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: from.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc to %q: %v", from.Attrs().Name, err)
+	}
+
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: from.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(to.Attrs().Index)},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect %q to %q: %v", from.Attrs().Name, to.Attrs().Name, err)
+	}
+
+	return nil
+}
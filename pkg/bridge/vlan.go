@@ -0,0 +1,119 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vishvananda/netlink"
+)
+
+// defaultVID 是开启 vlan_filtering 后网桥端口默认所属的 VLAN
+const defaultVID = 1
+
+// SetupBridgeVlan 开启网桥的 vlan_filtering, 并将网桥自身加入 VLAN, 使网关地址可以在该 VLAN 中访问
+func SetupBridgeVlan(br netlink.Link, vid int) error {
+	if err := netlink.BridgeSetVlanFiltering(br, true); err != nil {
+		return fmt.Errorf("failed to enable vlan filtering on %q: %v", br.Attrs().Name, err)
+	}
+
+	return setVlan(br, vid, true)
+}
+
+// SetPortVlan 将网桥端口设置为 VLAN 的 untagged 成员, 并以该 VLAN 作为 PVID
+func SetPortVlan(port string, vid int) error {
+	link, err := netlink.LinkByName(port)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", port, err)
+	}
+
+	return setVlan(link, vid, false)
+}
+
+// SetupVlanUplink 在宿主机网卡上创建 VLAN 子接口并接入网桥, 网桥中的报文从子接口发出时带上 VLAN 标签
+func SetupVlanUplink(master, br netlink.Link, vid, mtu int) (netlink.Link, error) {
+	name := VlanLinkName(master.Attrs().Name, vid)
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			MTU:         mtu,
+			ParentIndex: master.Attrs().Index,
+		},
+		VlanId: vid,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("failed to create vlan %q: %v", name, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = netlink.LinkSetMaster(link, br); err != nil {
+		return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", name, br.Attrs().Name, err)
+	}
+
+	if err = setVlan(link, vid, false); err != nil {
+		return nil, err
+	}
+
+	if err = netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// VlanLinkName 返回 VLAN 子接口的名称, 名称过长时使用 vlan<vid>
+func VlanLinkName(master string, vid int) string {
+	name := fmt.Sprintf("%s.%d", master, vid)
+	if len(name) > 15 {
+		name = fmt.Sprintf("vlan%d", vid)
+	}
+
+	return name
+}
+
+// CheckPortVlan 检查网桥端口是否以 VLAN 作为 PVID 的 untagged 成员
+func CheckPortVlan(portIndex, vid int) error {
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range vlans[int32(portIndex)] {
+		if int(info.Vid) == vid && info.PortVID() && info.EngressUntag() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("port with index %d is not an untagged member of vlan %d", portIndex, vid)
+}
+
+// setVlan 设置 VLAN 为 PVID 并且 untagged, 同时移除默认的 VLAN
+func setVlan(link netlink.Link, vid int, self bool) error {
+	if err := netlink.BridgeVlanAdd(link, uint16(vid), true, true, self, !self); err != nil {
+		return fmt.Errorf("failed to add vlan %d to %q: %v", vid, link.Attrs().Name, err)
+	}
+
+	if vid == defaultVID {
+		return nil
+	}
+
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range vlans[int32(link.Attrs().Index)] {
+		if info.Vid != defaultVID {
+			continue
+		}
+		if err = netlink.BridgeVlanDel(link, defaultVID, false, false, self, !self); err != nil {
+			return fmt.Errorf("failed to remove default vlan from %q: %v", link.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// CreateVRF 创建绑定到路由表 table 的 VRF 设备, 已经存在时检查路由表是否一致
+func CreateVRF(name string, table int) (netlink.Link, error) {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to lookup vrf %q: %v", name, err)
+		}
+
+		vrf := &netlink.Vrf{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Table:     uint32(table),
+		}
+		if err := netlink.LinkAdd(vrf); err != nil {
+			return nil, fmt.Errorf("failed to create vrf %q: %v", name, err)
+		}
+
+		if l, err = netlink.LinkByName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	vrf, ok := l.(*netlink.Vrf)
+	if !ok {
+		return nil, fmt.Errorf("%q already exists but is not a vrf", name)
+	}
+
+	if vrf.Table != uint32(table) {
+		return nil, fmt.Errorf("vrf %q is bound to table %d, expected %d", name, vrf.Table, table)
+	}
+
+	if err := netlink.LinkSetUp(vrf); err != nil {
+		return nil, err
+	}
+
+	return vrf, nil
+}
+
+// SetVRF 将网卡接入 VRF, 网卡上的直连路由会移动到 VRF 的路由表中
+func SetVRF(link, vrf netlink.Link) error {
+	if link.Attrs().MasterIndex == vrf.Attrs().Index {
+		return nil
+	}
+
+	if err := netlink.LinkSetMaster(link, vrf); err != nil {
+		return fmt.Errorf("failed to connect %q to vrf %q: %v", link.Attrs().Name, vrf.Attrs().Name, err)
+	}
+
+	return nil
+}
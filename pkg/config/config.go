@@ -3,9 +3,12 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 const (
@@ -13,17 +16,58 @@ const (
 	DefaultSubnetFile = "/run/raccoon/subnet.json"
 	// DefaultBridgeName 是默认的网桥名称
 	DefaultBridgeName = "cni0"
+	// DefaultMTU 是默认的MTU
+	DefaultMTU = 1500
+	// DefaultCNIConfFile 是 raccoon 插件配置的默认路径, 由 ConfigMap 挂载
+	DefaultCNIConfFile = "/etc/kube-raccoon/cni-conf.json"
+	// DefaultCNIConfDir 是默认的CNI配置目录
+	DefaultCNIConfDir = "/etc/cni/net.d"
+
+	// ModeBridge 是默认的接入模式, 容器通过 veth 接入网桥
+	ModeBridge = "bridge"
+	// ModePTP 是点对点路由模式, 容器通过 veth 和 /32 路由接入宿主机, 不创建网桥
+	ModePTP = "ptp"
+	// ModeMacvlan 在宿主机网卡上创建 macvlan 子接口, 容器直接接入底层二层网络
+	ModeMacvlan = "macvlan"
+	// ModeIPvlan 在宿主机网卡上创建 ipvlan 子接口, 支持 l2 和 l3 模式
+	ModeIPvlan = "ipvlan"
+	// ModeTap 在网桥模式的基础上在容器中创建 tap 设备, 用于基于虚拟机的沙箱
+	ModeTap = "tap"
+	// ModeFlat 在 ptp 模式的基础上使用宿主机子网中的地址, 其他机器通过宿主机网卡上的 proxy ARP 直接访问容器
+	ModeFlat = "flat"
+
+	// DefaultTapName 是 tap 模式下默认的 tap 设备名称
+	DefaultTapName = "tap0"
+	// TapRedirectTC 通过 tc 在容器端 veth 和 tap 之间双向重定向报文
+	TapRedirectTC = "tc"
+	// TapRedirectMacvtap 在容器端 veth 上创建 passthru 模式的 macvtap 作为 tap
+	TapRedirectMacvtap = "macvtap"
+
+	// IPvlanModeL2 是 ipvlan 的二层模式
+	IPvlanModeL2 = "l2"
+	// IPvlanModeL3 是 ipvlan 的三层模式, 容器不处理 ARP
+	IPvlanModeL3 = "l3"
+
+	confListName   = "10-raccoon.conflist" // raccoond 生成的 conflist 文件名称
+	legacyConfName = "10-raccoon.conf"     // 旧版本安装的单插件配置文件名称
 )
 
 // SubnetConfig 是子网配置结构体
 type SubnetConfig struct {
-	Subnet string `json:"subnet"`
-	Bridge string `json:"bridge"`
+	Network  string `json:"network,omitempty"` // 默认网络的名称, 只写入 DefaultSubnetFile
+	Subnet   string `json:"subnet"`
+	Bridge   string `json:"bridge"`
+	MTU      int    `json:"mtu,omitempty"`      // 由 raccoond 根据宿主机网卡探测得到
+	HostLink string `json:"hostLink,omitempty"` // raccoond 找到的宿主机网卡, macvlan 和 ipvlan 模式默认使用
+	VLAN     int    `json:"vlan,omitempty"`     // 附加网络在宿主机网卡上使用的 VLAN
+
+	Routes []*types.Route `json:"routes,omitempty"` // 附加网络在容器中添加的路由
 }
 
 // RuntimeConfig 是运行时配置结构体
 type RuntimeConfig struct {
-	Config map[string]interface{} `json:"config"`
+	Config         map[string]interface{} `json:"config"`
+	PodAnnotations map[string]string      `json:"io.kubernetes.cri.pod-annotations,omitempty"` // containerd 传入的 Pod 注解
 }
 
 // Args 是插件参数结构体
@@ -37,16 +81,52 @@ type PluginConfig struct {
 	RuntimeConfig *RuntimeConfig `json:"runtimeConfig,omitempty"`
 	Args          *Args          `json:"args"`
 	DataDir       string         `json:"dataDir"`
+
+	DefaultNetwork string `json:"-"` // 网络配置中的网络名称, 使用租户网络时 Name 被替换为租户网络的名称
+
+	// 以下配置优先于 SubnetConfig 中的同名配置
+	Bridge           string `json:"bridge"`           // 网桥名称
+	MTU              int    `json:"mtu"`              // 网桥和 veth 的 MTU
+	HairpinMode      bool   `json:"hairpinMode"`      // 是否在宿主机 veth 上开启 hairpin
+	PromiscMode      bool   `json:"promiscMode"`      // 是否开启网桥的混杂模式
+	IsDefaultGateway bool   `json:"isDefaultGateway"` // 是否在容器中添加经由网关的默认路由
+	IPMasq           bool   `json:"ipMasq"`           // 是否由插件为容器添加 SNAT 规则
+	Mode             string `json:"mode"`             // 接入模式, 支持 bridge、ptp、macvlan、ipvlan、tap 和 flat
+	Master           string `json:"master"`           // macvlan 和 ipvlan 的父网卡, 默认为 raccoond 找到的宿主机网卡
+	Gateway          string `json:"gateway"`          // macvlan 和 ipvlan 模式下容器的默认网关, 默认为 master 上默认路由的网关
+	IPvlanMode       string `json:"ipvlanMode"`       // ipvlan 的模式, 支持 l2 和 l3
+	TapName          string `json:"tapName"`          // tap 模式下容器中的 tap 设备名称
+	TapRedirect      string `json:"tapRedirect"`      // tap 与容器端 veth 的连接方式, 支持 tc 和 macvtap
+	VLAN             int    `json:"vlan"`             // 容器端口所属的 VLAN, 网桥会开启 vlan_filtering
+	MacFromIP        bool   `json:"macFromIP"`        // 是否根据容器地址生成容器端 veth 的 MAC 地址
+
+	Sysctls        map[string]string `json:"sysctls"`        // 在容器中设置的 sysctl
+	AllowedSysctls []string          `json:"allowedSysctls"` // 允许在容器中设置的 sysctl, 为空时使用 DefaultAllowedSysctls
 }
 
 // CNIConfig 是CNI配置结构体
 type CNIConfig struct {
 	PluginConfig
-	SubnetConfig
+	SubnetConfig `json:"-"` // 子网配置来自 raccoond, 不属于网络配置
 }
 
-// LoadSubnetConfig 从文件中加载子网配置
-func LoadSubnetConfig() (*SubnetConfig, error) {
+// LoadSubnetConfig 从文件中加载子网配置, 优先使用 raccoond 为同名附加网络写入的子网配置
+// 没有附加网络的子网配置时只有默认网络可以使用 DefaultSubnetFile, 否则附加网络会从默认网络的子网中分配重复的地址
+func LoadSubnetConfig(network string) (*SubnetConfig, error) {
+	if network != "" {
+		data, err := os.ReadFile(networkSubnetFile(network))
+		if err == nil {
+			c := &SubnetConfig{}
+			if err = json.Unmarshal(data, c); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
 	data, err := os.ReadFile(DefaultSubnetFile)
 	if err != nil {
 		return nil, err
@@ -57,22 +137,89 @@ func LoadSubnetConfig() (*SubnetConfig, error) {
 		return nil, err
 	}
 
+	// 旧版本 raccoond 写入的配置没有网络名称, 视为默认网络
+	if network != "" && c.Network != "" && c.Network != network {
+		return nil, fmt.Errorf("network %q is not set up by raccoond: %w", network, os.ErrNotExist)
+	}
+
 	return c, nil
 }
 
-// LoadCNIConfig 从文件中加载CNI配置
-func LoadCNIConfig(stdin []byte) (*CNIConfig, error) {
+// LoadCNIConfig 从文件中加载CNI配置, args 为 CNI_ARGS, 用于选择 Pod 所在命名空间的租户网络
+func LoadCNIConfig(stdin []byte, args string) (*CNIConfig, error) {
 	pluginConf, err := parsePluginConfig(stdin)
 	if err != nil {
 		return nil, err
 	}
 
-	subnetConf, err := LoadSubnetConfig()
+	tenant, err := TenantNetwork(pluginConf, args)
 	if err != nil {
 		return nil, err
 	}
+	useTenant(pluginConf, tenant)
 
-	return &CNIConfig{*pluginConf, *subnetConf}, nil
+	subnetConf, err := LoadSubnetConfig(pluginConf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCNIConfig(pluginConf, subnetConf), nil
+}
+
+// LoadCNIConfigForTenant 从文件中加载CNI配置, tenant 为 ADD 时为容器选择的租户网络, 为空时使用默认网络
+// DEL 和 CHECK 使用 ADD 时的选择, 命名空间标签之后的变化不影响已经创建的容器
+func LoadCNIConfigForTenant(stdin []byte, tenant string) (*CNIConfig, error) {
+	pluginConf, err := parsePluginConfig(stdin)
+	if err != nil {
+		return nil, err
+	}
+	useTenant(pluginConf, tenant)
+
+	subnetConf, err := LoadSubnetConfig(pluginConf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCNIConfig(pluginConf, subnetConf), nil
+}
+
+// LoadCNIConfigWithoutSubnet 只加载插件配置, 用于子网配置已经不存在时删除容器网络
+func LoadCNIConfigWithoutSubnet(stdin []byte, tenant string) (*CNIConfig, error) {
+	pluginConf, err := parsePluginConfig(stdin)
+	if err != nil {
+		return nil, err
+	}
+	useTenant(pluginConf, tenant)
+
+	return newCNIConfig(pluginConf, &SubnetConfig{}), nil
+}
+
+// newCNIConfig 合并插件配置和子网配置
+func newCNIConfig(pluginConf *PluginConfig, subnetConf *SubnetConfig) *CNIConfig {
+	// 插件配置优先，未配置时使用子网配置，最后使用默认值
+	if pluginConf.Bridge == "" {
+		pluginConf.Bridge = subnetConf.Bridge
+	}
+	if pluginConf.Bridge == "" {
+		pluginConf.Bridge = DefaultBridgeName
+	}
+	if pluginConf.MTU == 0 {
+		pluginConf.MTU = subnetConf.MTU
+	}
+	if pluginConf.MTU == 0 {
+		pluginConf.MTU = DefaultMTU
+	}
+	if pluginConf.Master == "" {
+		pluginConf.Master = subnetConf.HostLink
+	}
+	if pluginConf.VLAN == 0 {
+		pluginConf.VLAN = subnetConf.VLAN
+	}
+	subnetConf.Bridge = pluginConf.Bridge
+	subnetConf.MTU = pluginConf.MTU
+	subnetConf.VLAN = pluginConf.VLAN
+
+	return &CNIConfig{*pluginConf, *subnetConf}
 }
 
 // StoreSubnetConfig 存储子网配置到文件
@@ -85,13 +232,156 @@ func StoreSubnetConfig(c *SubnetConfig) error {
 	return os.WriteFile(DefaultSubnetFile, data, 0644)
 }
 
+// GenerateConfList 根据 raccoon 插件配置生成 conflist, 按需在 raccoon 之后追加 portmap 和 bandwidth 插件
+func GenerateConfList(pluginConf []byte, portmap, bandwidth bool) ([]byte, error) {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(pluginConf, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	confList := map[string]interface{}{
+		"name":       conf["name"],
+		"cniVersion": conf["cniVersion"],
+	}
+
+	// 已经是 conflist 时在原有插件之后追加
+	var plugins []interface{}
+	if list, ok := conf["plugins"].([]interface{}); ok {
+		plugins = list
+	} else {
+		delete(conf, "name")
+		delete(conf, "cniVersion")
+		plugins = []interface{}{conf}
+	}
+
+	if portmap {
+		plugins = append(plugins, map[string]interface{}{
+			"type":         "portmap",
+			"snat":         true,
+			"capabilities": map[string]bool{"portMappings": true},
+		})
+	}
+
+	if bandwidth {
+		plugins = append(plugins, map[string]interface{}{
+			"type":         "bandwidth",
+			"capabilities": map[string]bool{"bandwidth": true},
+		})
+	}
+	confList["plugins"] = plugins
+
+	return json.MarshalIndent(confList, "", "  ")
+}
+
+// LoadPluginConfig 解析 --cni-conf-file 中的 raccoon 插件配置, 已经是 conflist 时使用其中的 raccoon 插件和 conflist 的网络名称
+func LoadPluginConfig(pluginConf []byte) (*PluginConfig, error) {
+	list := struct {
+		Name    string            `json:"name"`
+		Plugins []json.RawMessage `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(pluginConf, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin configuration: %v", err)
+	}
+
+	data := pluginConf
+	for _, p := range list.Plugins {
+		plugin := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(p, &plugin); err == nil && plugin.Type == "raccoon" {
+			data = p
+		}
+	}
+
+	c, err := parsePluginConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = list.Name
+	c.DefaultNetwork = list.Name
+
+	return c, nil
+}
+
+// StoreConfList 将 conflist 写入CNI配置目录, 并删除旧版本安装的单插件配置
+func StoreConfList(dir string, data []byte) error {
+	// 先写入临时文件再重命名, 避免容器运行时读取到不完整的配置
+	tmp := filepath.Join(dir, "."+confListName)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, confListName)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, legacyConfName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
 // parsePluginConfig 解析插件配置
 func parsePluginConfig(stdin []byte) (*PluginConfig, error) {
-	c := &PluginConfig{}
+	// 默认在容器中添加默认路由, 默认使用网桥模式
+	c := &PluginConfig{
+		IsDefaultGateway: true,
+		Mode:             ModeBridge,
+		IPvlanMode:       IPvlanModeL2,
+		TapName:          DefaultTapName,
+		TapRedirect:      TapRedirectTC,
+	}
 
 	if err := json.Unmarshal(stdin, c); err != nil {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
+	c.DefaultNetwork = c.Name
+
+	switch c.Mode {
+	case ModeBridge, ModePTP, ModeMacvlan, ModeIPvlan, ModeTap, ModeFlat:
+	default:
+		return nil, fmt.Errorf("unsupported mode %q", c.Mode)
+	}
+
+	// flat 模式下容器地址在底层网络中可以直接访问, 不需要 SNAT
+	if c.Mode == ModeFlat && c.IPMasq {
+		return nil, fmt.Errorf("ipMasq is not supported in %s mode", c.Mode)
+	}
+
+	if c.Gateway != "" && net.ParseIP(c.Gateway).To4() == nil {
+		return nil, fmt.Errorf("invalid gateway %q", c.Gateway)
+	}
+
+	switch c.IPvlanMode {
+	case IPvlanModeL2, IPvlanModeL3:
+	default:
+		return nil, fmt.Errorf("unsupported ipvlan mode %q", c.IPvlanMode)
+	}
+
+	switch c.TapRedirect {
+	case TapRedirectTC, TapRedirectMacvtap:
+	default:
+		return nil, fmt.Errorf("unsupported tap redirect %q", c.TapRedirect)
+	}
+
+	if err := validateVLAN(c.VLAN); err != nil {
+		return nil, err
+	}
+
+	// 解析 prevResult, CHECK 和插件链需要使用
+	if err := version.ParsePrevResult(&c.NetConf); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
 
 	return c, nil
 }
+
+// validateVLAN 检查 VLAN 是否合法, 0 表示不使用 VLAN
+func validateVLAN(vlan int) error {
+	if vlan < 0 || vlan > 4094 {
+		return fmt.Errorf("invalid vlan %d, must be between 1 and 4094", vlan)
+	}
+
+	return nil
+}
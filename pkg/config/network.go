@@ -0,0 +1,207 @@
+package config
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultNetworkDir 是附加网络子网配置的目录, 文件名为网络名称
+	DefaultNetworkDir = "/run/raccoon/networks"
+	// DefaultFlatBlock 是 flat 网络中每个节点地址块的默认前缀长度
+	DefaultFlatBlock = 28
+	// FlatBlockAnnotationPrefix 是节点上记录 flat 网络地址块的注解前缀, 后面是网络名称
+	FlatBlockAnnotationPrefix = "raccoon.io/flat-"
+)
+
+// NetworkConfig 是 raccoond 管理的附加网络配置, 插件根据网络名称选择对应的子网配置
+type NetworkConfig struct {
+	Name     string         `json:"name"`             // 网络名称, 与 CNI 配置中的 name 一致
+	CIDR     string         `json:"cidr"`             // 整个集群的网段, 按照节点 PodCIDR 在集群网段中的偏移为每个节点划分子网
+	Bridge   string         `json:"bridge"`           // 网桥名称
+	Isolated bool           `json:"isolated"`         // 是否禁止与其他网络的网桥之间转发
+	VLAN     int            `json:"vlan,omitempty"`   // 网络对应的 VLAN, 网桥通过宿主机网卡上的 VLAN 子接口接入物理网络
+	Tenant   bool           `json:"tenant"`           // 是否为租户网络, 命名空间通过 TenantLabel 标签选择租户网络
+	Table    int            `json:"table,omitempty"`  // 租户网络 VRF 使用的路由表
+	VRF      string         `json:"vrf,omitempty"`    // 租户网络的 VRF 设备名称
+	Flat     bool           `json:"flat"`             // 是否为 flat 网络, 每个节点从宿主机子网的 cidr 中认领一个地址块
+	Block    int            `json:"block,omitempty"`  // flat 网络中每个节点地址块的前缀长度
+	Routes   []*types.Route `json:"routes,omitempty"` // 在容器中添加的路由
+	Routable bool           `json:"routable"`         // 是否通过 BGP 通告节点在该网络中的子网
+}
+
+// LoadNetworkConfigs 从文件中加载附加网络配置
+func LoadNetworkConfigs(file string) ([]NetworkConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []NetworkConfig
+	if err = json.Unmarshal(data, &networks); err != nil {
+		return nil, fmt.Errorf("failed to parse networks: %v", err)
+	}
+
+	names := make(map[string]bool)
+	tables := make(map[int]bool)
+	for i := range networks {
+		n := &networks[i]
+		if n.Name == "" {
+			return nil, fmt.Errorf("network name is required")
+		}
+		if names[n.Name] {
+			return nil, fmt.Errorf("network %q is duplicated", n.Name)
+		}
+		names[n.Name] = true
+
+		_, cidr, err := net.ParseCIDR(n.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("network %q has invalid cidr: %v", n.Name, err)
+		}
+
+		if err := validateVLAN(n.VLAN); err != nil {
+			return nil, fmt.Errorf("network %q: %v", n.Name, err)
+		}
+
+		// 网卡名称最长为 15 个字符
+		if n.Bridge == "" {
+			n.Bridge = fmt.Sprintf("%.15s", "rcn-"+n.Name)
+		}
+
+		// 租户网络和 VLAN 网络与主路由表隔离, 通告后外部可以绕过隔离访问, flat 网络的地址已经在宿主机子网中
+		if n.Routable && (n.Tenant || n.VLAN != 0 || n.Flat) {
+			return nil, fmt.Errorf("network %q with tenant, vlan or flat can not be routable", n.Name)
+		}
+
+		if n.Flat {
+			if n.Tenant || n.VLAN != 0 {
+				return nil, fmt.Errorf("flat network %q does not support tenant or vlan", n.Name)
+			}
+			if n.Block == 0 {
+				n.Block = DefaultFlatBlock
+			}
+			if ones, _ := cidr.Mask.Size(); n.Block < ones || n.Block > 30 {
+				return nil, fmt.Errorf("flat network %q has invalid block /%d", n.Name, n.Block)
+			}
+			continue
+		}
+
+		if !n.Tenant {
+			continue
+		}
+		if n.Table <= 0 || n.Table == unix.RT_TABLE_MAIN || n.Table == unix.RT_TABLE_LOCAL || n.Table == unix.RT_TABLE_DEFAULT {
+			return nil, fmt.Errorf("tenant network %q requires a valid table", n.Name)
+		}
+		if tables[n.Table] {
+			return nil, fmt.Errorf("table %d of tenant network %q is duplicated", n.Table, n.Name)
+		}
+		tables[n.Table] = true
+		if n.VRF == "" {
+			n.VRF = fmt.Sprintf("%.15s", "vrf-"+n.Name)
+		}
+	}
+
+	return networks, nil
+}
+
+// NodeSubnet 根据节点 PodCIDR 在集群网段中的偏移, 计算节点在附加网络中的子网
+// 例如集群网段为 10.244.0.0/16, 节点 PodCIDR 为 10.244.3.0/24, 附加网络为 10.10.0.0/16 时, 节点子网为 10.10.3.0/24
+func NodeSubnet(clusterCIDR, podCIDR, networkCIDR *net.IPNet) (*net.IPNet, error) {
+	clusterOnes, _ := clusterCIDR.Mask.Size()
+	podOnes, _ := podCIDR.Mask.Size()
+	networkOnes, _ := networkCIDR.Mask.Size()
+
+	ones := networkOnes + podOnes - clusterOnes
+	if ones > 30 {
+		return nil, fmt.Errorf("network %s is too small for %d nodes", networkCIDR, 1<<(podOnes-clusterOnes))
+	}
+
+	clusterIP, podIP, networkIP := clusterCIDR.IP.To4(), podCIDR.IP.To4(), networkCIDR.IP.To4()
+	if clusterIP == nil || podIP == nil || networkIP == nil {
+		return nil, fmt.Errorf("only ipv4 networks are supported")
+	}
+
+	// 节点在集群网段中的序号
+	index := (binary.BigEndian.Uint32(podIP) - binary.BigEndian.Uint32(clusterIP)) >> (32 - podOnes)
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(networkIP)+index<<(32-ones))
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}, nil
+}
+
+// FlatBlocks 将 flat 网络的 cidr 按照前缀长度 ones 划分为地址块
+func FlatBlocks(cidr *net.IPNet, ones int) ([]*net.IPNet, error) {
+	cidrOnes, _ := cidr.Mask.Size()
+	ip := cidr.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("only ipv4 networks are supported")
+	}
+	if ones < cidrOnes || ones > 32 {
+		return nil, fmt.Errorf("block /%d is out of %s", ones, cidr)
+	}
+
+	start := binary.BigEndian.Uint32(ip)
+	blocks := make([]*net.IPNet, 0, 1<<(ones-cidrOnes))
+	for i := uint32(0); i < 1<<(ones-cidrOnes); i++ {
+		blockIP := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(blockIP, start+i<<(32-ones))
+		blocks = append(blocks, &net.IPNet{IP: blockIP, Mask: net.CIDRMask(ones, 32)})
+	}
+
+	return blocks, nil
+}
+
+// StoreNetworkSubnetConfig 存储附加网络的子网配置到文件
+func StoreNetworkSubnetConfig(network string, c *SubnetConfig) error {
+	if err := os.MkdirAll(DefaultNetworkDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(networkSubnetFile(network), data, 0644)
+}
+
+// PruneNetworkSubnetConfigs 删除不在 networks 中的附加网络子网配置
+func PruneNetworkSubnetConfigs(networks []NetworkConfig) error {
+	entries, err := os.ReadDir(DefaultNetworkDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, n := range networks {
+		keep[filepath.Base(networkSubnetFile(n.Name))] = true
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") || keep[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(DefaultNetworkDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// networkSubnetFile 返回附加网络子网配置的文件路径
+func networkSubnetFile(network string) string {
+	return filepath.Join(DefaultNetworkDir, network+".json")
+}
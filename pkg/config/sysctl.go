@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PodSysctlsAnnotation 是设置容器 sysctl 的 Pod 注解, 值为 JSON 对象, 需要运行时通过 runtimeConfig 传入 Pod 注解
+const PodSysctlsAnnotation = "raccoon.io/pod-sysctls"
+
+// DefaultAllowedSysctls 是默认允许在容器中设置的 sysctl, 以 * 结尾的表示前缀, <ifname> 会被替换为容器网卡名称
+var DefaultAllowedSysctls = []string{
+	"net.core.somaxconn",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.tcp_*",
+	"net.ipv4.conf.<ifname>.*",
+	"net.ipv4.neigh.<ifname>.*",
+}
+
+// PodSysctls 依次合并网络配置、Pod 注解和 args.cni.sysctls 中的 sysctl, 后者优先, 不在允许列表中时返回错误
+func (c *PluginConfig) PodSysctls(ifName string) (map[string]string, error) {
+	sysctls := make(map[string]string)
+	for k, v := range c.Sysctls {
+		sysctls[k] = v
+	}
+
+	// containerd 声明 io.kubernetes.cri.pod-annotations 能力后在 runtimeConfig 中传入 Pod 注解
+	if c.RuntimeConfig != nil {
+		if raw, ok := c.RuntimeConfig.PodAnnotations[PodSysctlsAnnotation]; ok {
+			m := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(raw), &m); err != nil {
+				return nil, fmt.Errorf("failed to parse annotation %s: %v", PodSysctlsAnnotation, err)
+			}
+			for k, v := range m {
+				sysctls[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	// 通过 Multus 的 cni-args 可以为每个 Pod 设置不同的值
+	if c.Args != nil && c.Args.Cni != nil {
+		if raw, ok := c.Args.Cni["sysctls"]; ok {
+			m, ok := raw.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("args.cni.sysctls must be an object")
+			}
+			for k, v := range m {
+				sysctls[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	allowed := c.AllowedSysctls
+	if allowed == nil {
+		allowed = DefaultAllowedSysctls
+	}
+
+	for k := range sysctls {
+		if !sysctlAllowed(k, ifName, allowed) {
+			return nil, fmt.Errorf("sysctl %q is not allowed", k)
+		}
+	}
+
+	return sysctls, nil
+}
+
+// sysctlAllowed 判断 sysctl 是否在允许列表中
+func sysctlAllowed(key, ifName string, allowed []string) bool {
+	for _, pattern := range allowed {
+		pattern = strings.ReplaceAll(pattern, "<ifname>", ifName)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+				return true
+			}
+			continue
+		}
+		if key == pattern {
+			return true
+		}
+	}
+
+	return false
+}
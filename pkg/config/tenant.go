@@ -0,0 +1,100 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// TenantLabel 是命名空间上选择租户网络的标签, 值为租户网络的名称
+	TenantLabel = "raccoon.io/tenant"
+	// DefaultTenantsFile 是 raccoond 写入的命名空间到租户网络的映射
+	DefaultTenantsFile = "/run/raccoon/tenants.json"
+)
+
+// K8sArgs 是 kubelet 通过 CNI_ARGS 传入的参数
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+}
+
+// StoreTenants 存储命名空间到租户网络的映射
+func StoreTenants(tenants map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(DefaultTenantsFile), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tenants)
+	if err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名, 避免插件读到不完整的文件
+	tmp := DefaultTenantsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, DefaultTenantsFile)
+}
+
+// LoadTenants 加载命名空间到租户网络的映射, 文件不存在时返回空映射
+func LoadTenants() (map[string]string, error) {
+	tenants := make(map[string]string)
+
+	data, err := os.ReadFile(DefaultTenantsFile)
+	if os.IsNotExist(err) {
+		return tenants, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants: %v", err)
+	}
+
+	return tenants, nil
+}
+
+// TenantNetwork 根据 Pod 所在命名空间的标签选择租户网络, 不使用租户网络时返回空字符串
+// 只有默认网络会被替换, 附加网络保持不变
+func TenantNetwork(c *PluginConfig, args string) (string, error) {
+	if _, err := os.Stat(networkSubnetFile(c.DefaultNetwork)); err == nil {
+		return "", nil
+	}
+
+	k8sArgs := &K8sArgs{}
+	k8sArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args, k8sArgs); err != nil {
+		return "", fmt.Errorf("failed to parse args: %v", err)
+	}
+
+	namespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	if namespace == "" {
+		return "", nil
+	}
+
+	tenants, err := LoadTenants()
+	if err != nil {
+		return "", err
+	}
+
+	return tenants[namespace], nil
+}
+
+// useTenant 使用租户网络代替默认网络, 租户网络使用自己的子网配置、网桥和存储
+func useTenant(c *PluginConfig, network string) {
+	if network == "" {
+		return
+	}
+
+	// 租户网络的网桥由 raccoond 创建并接入 VRF, 不能使用插件配置中的网桥
+	c.Name = network
+	c.Bridge = ""
+}
@@ -48,6 +48,11 @@ func (im *IPAddressManagement) Mask() net.IPMask {
 	return im.subnet.Mask
 }
 
+// Subnet 获取分配地址的子网
+func (im *IPAddressManagement) Subnet() *net.IPNet {
+	return im.subnet
+}
+
 // Gateway 获取网关
 func (im *IPAddressManagement) Gateway() net.IP {
 	return im.gateway
@@ -68,8 +73,8 @@ func (im *IPAddressManagement) NextIP(ip net.IP) (net.IP, error) {
 	return next, nil
 }
 
-// AllocateIP 分配IP地址
-func (im *IPAddressManagement) AllocateIP(id, ifName string) (net.IP, error) {
+// AllocateIP 分配IP地址, 容器已经分配过地址时返回已有的地址, 第二个返回值表示地址是否由本次调用分配
+func (im *IPAddressManagement) AllocateIP(id, ifName string) (net.IP, bool, error) {
 	// 加锁
 	im.store.Lock()
 	// 解锁
@@ -77,14 +82,14 @@ func (im *IPAddressManagement) AllocateIP(id, ifName string) (net.IP, error) {
 
 	// 从本地数据中获取IP地址
 	if err := im.store.LocalData(); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// 先尝试获取已分配的IP地址
 	ip, _ := im.store.GetIPByContainerID(id)
 	if len(ip) > 0 {
 		// 已分配，直接返回
-		return ip, nil
+		return ip, false, nil
 	}
 
 	// 获取最后一个IP地址
@@ -105,13 +110,15 @@ func (im *IPAddressManagement) AllocateIP(id, ifName string) (net.IP, error) {
 			start = im.gateway
 			continue
 		} else if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		// 检查 IP 是否是未分配的
 		if !im.store.Contain(next) {
-			err = im.store.Add(next, id, ifName) // 调用存储器添加IP地址
-			return next, err
+			if err := im.store.Add(next, id, ifName); err != nil { // 调用存储器添加IP地址
+				return nil, false, err
+			}
+			return next, true, nil
 		}
 
 		start = next // 继续搜索下一个IP地址
@@ -124,11 +131,52 @@ func (im *IPAddressManagement) AllocateIP(id, ifName string) (net.IP, error) {
 		log.Printf("IP Address: %s", next)
 	}
 
-	return nil, fmt.Errorf("no available IP address")
+	return nil, false, fmt.Errorf("no available IP address")
 }
 
-// ReleaseIP 释放IP地址
-func (im *IPAddressManagement) ReleaseIP(id string) error {
+// ReserveIP 记录由其他插件分配的IP地址, 避免再分配给其他容器, 返回值表示地址是否由本次调用记录
+func (im *IPAddressManagement) ReserveIP(ip net.IP, id, ifName string) (bool, error) {
+	if !im.subnet.Contains(ip) {
+		return false, fmt.Errorf("ip address %s is not in subnet %s", ip, im.subnet)
+	}
+
+	im.store.Lock()
+	defer im.store.Unlock()
+
+	if err := im.store.LocalData(); err != nil {
+		return false, err
+	}
+
+	// 已经记录过，直接返回
+	if cur, ok := im.store.GetIPByContainerID(id); ok && cur.Equal(ip) {
+		return false, nil
+	}
+
+	if im.store.Contain(ip) || ip.Equal(im.gateway) {
+		return false, fmt.Errorf("ip address %s is already in use", ip)
+	}
+
+	if err := im.store.Add(ip, id, ifName); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RecordLink 在存储中记录容器的宿主机端 veth 名称和容器网卡的 MAC 地址
+func (im *IPAddressManagement) RecordLink(id, hostVeth, mac string) error {
+	im.store.Lock()
+	defer im.store.Unlock()
+
+	if err := im.store.LocalData(); err != nil {
+		return err
+	}
+
+	return im.store.SetLink(id, hostVeth, mac)
+}
+
+// RecordChained 在存储中记录容器的 veth 由之前的插件创建
+func (im *IPAddressManagement) RecordChained(id string) error {
 	im.store.Lock()
 	defer im.store.Unlock()
 
@@ -136,8 +184,107 @@ func (im *IPAddressManagement) ReleaseIP(id string) error {
 		return err
 	}
 
+	return im.store.SetChained(id)
+}
+
+// LookupHostVeth 从存储中获取容器的宿主机端 veth 名称和 veth 是否由之前的插件创建, 没有记录时返回空字符串, 不依赖子网配置
+func LookupHostVeth(s *store.Store, id string) (string, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return "", false, err
+	}
+
+	hostVeth, _, _ := s.GetLinkByContainerID(id)
+	return hostVeth, s.Chained(id), nil
+}
+
+// LookupIP 从存储中获取容器的IP地址, 没有记录时返回 nil, 不依赖子网配置
+func LookupIP(s *store.Store, id string) (net.IP, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return nil, err
+	}
+
+	ip, _ := s.GetIPByContainerID(id)
+	return ip, nil
+}
+
+// LookupHostVeths 从存储中获取所有容器地址对应的宿主机端 veth 名称, 供 raccoond 在 veth 上设置网络策略
+func LookupHostVeths(s *store.Store) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return nil, err
+	}
+
+	return s.HostVeths(), nil
+}
+
+// LookupTenant 从默认网络的存储中获取 ADD 时为容器选择的租户网络
+// 没有记录时, 默认网络中存在该容器则返回空字符串, 否则 ok 为 false
+func LookupTenant(s *store.Store, id string) (network string, ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return "", false, err
+	}
+
+	if network, ok := s.Tenant(id); ok {
+		return network, true, nil
+	}
+
+	_, ok = s.GetIPByContainerID(id)
+	return "", ok, nil
+}
+
+// RecordTenant 在默认网络的存储中记录为容器选择的租户网络
+func RecordTenant(s *store.Store, id, network string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return err
+	}
+
+	return s.SetTenant(id, network)
+}
+
+// ForgetTenant 删除容器的租户网络记录
+func ForgetTenant(s *store.Store, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return err
+	}
+
+	return s.DelTenant(id)
+}
+
+// ReleaseIP 释放IP地址
+func (im *IPAddressManagement) ReleaseIP(id string) error {
+	_, err := ReleaseIPByContainerID(im.store, id)
+	return err
+}
+
+// ReleaseIPByContainerID 释放容器的IP地址并返回被释放的IP地址, 不依赖子网配置
+func ReleaseIPByContainerID(s *store.Store, id string) (net.IP, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.LocalData(); err != nil {
+		return nil, err
+	}
+
 	// 从存储中删除IP地址
-	return im.store.Del(id)
+	ip, _ := s.GetIPByContainerID(id)
+	return ip, s.Del(id)
 }
 
 // CheckIP 检查IP地址是否可用
@@ -0,0 +1,83 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const (
+	setPrefix    = "raccoon-" // raccoond 创建的 ipset 的名称前缀
+	setTmpSuffix = "-tmp"     // 替换 ipset 内容时使用的临时 ipset 的后缀
+
+	setTypeIP  = "hash:ip"  // Pod 地址
+	setTypeNet = "hash:net" // ipBlock, except 为 nomatch 条目
+)
+
+// IPSet 是规则引用的 ipset
+type IPSet struct {
+	Name    string
+	Type    string
+	Entries []string
+}
+
+// syncIPSets 以 ipset restore 创建或更新 ipset, 新内容写入临时 ipset 后与原 ipset 交换, 规则不会匹配到不完整的内容
+func syncIPSets(sets map[string]*IPSet) error {
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		set := sets[name]
+		tmp := name + setTmpSuffix
+		fmt.Fprintf(&buf, "create %s %s -exist\n", tmp, set.Type)
+		fmt.Fprintf(&buf, "flush %s\n", tmp)
+		for _, entry := range set.Entries {
+			fmt.Fprintf(&buf, "add %s %s -exist\n", tmp, entry)
+		}
+		fmt.Fprintf(&buf, "create %s %s -exist\n", name, set.Type)
+		fmt.Fprintf(&buf, "swap %s %s\n", tmp, name)
+		fmt.Fprintf(&buf, "destroy %s\n", tmp)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	return run(&buf, "ipset", "restore")
+}
+
+// pruneIPSets 删除 raccoond 创建的不在 sets 中的 ipset, 需要在规则不再引用它们之后调用
+func pruneIPSets(sets map[string]*IPSet) error {
+	out, err := exec.Command("ipset", "list", "-n").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipset list failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var buf bytes.Buffer
+	for _, name := range strings.Fields(string(out)) {
+		if _, ok := sets[name]; !ok && strings.HasPrefix(name, setPrefix) {
+			fmt.Fprintf(&buf, "destroy %s\n", name)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	return run(&buf, "ipset", "restore")
+}
+
+// run 执行命令并从 stdin 读取输入
+func run(stdin *bytes.Buffer, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
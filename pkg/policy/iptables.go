@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// PolicyChain 是 FORWARD 和 INPUT 链开头跳转的网络策略链, 每次同步时重新生成
+	// 入方向的规则匹配 Pod 地址, 在 INPUT 中不会匹配, 出方向的规则在 INPUT 中限制 Pod 访问本节点
+	PolicyChain = "RACCOON-POLICY"
+
+	ingressChainPrefix = "RACCOON-PI-" // Pod 入方向的链
+	egressChainPrefix  = "RACCOON-PE-" // Pod 出方向的链
+)
+
+// Apply 创建规则引用的 ipset, 以 iptables-restore 一次性替换 PolicyChain 和所有 Pod 的链, 并删除不再使用的链和 ipset
+func (r *Ruleset) Apply() error {
+	if err := syncIPSets(r.Sets); err != nil {
+		return err
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+
+	existing, err := ipt.ListChains("filter")
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, chain := range existing {
+		if _, ok := r.Chains[chain]; !ok && (strings.HasPrefix(chain, ingressChainPrefix) || strings.HasPrefix(chain, egressChainPrefix)) {
+			stale = append(stale, chain)
+		}
+	}
+
+	chains := make([]string, 0, len(r.Chains))
+	for chain := range r.Chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+
+	// --noflush 时声明已经存在的链会清空该链, 不影响其他链
+	var buf bytes.Buffer
+	buf.WriteString("*filter\n")
+	for _, chain := range append(append([]string{PolicyChain}, chains...), stale...) {
+		fmt.Fprintf(&buf, ":%s - [0:0]\n", chain)
+	}
+	// 已经建立的连接不再检查, 策略变化只影响新连接
+	writeRule(&buf, PolicyChain, []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"})
+	for _, rule := range r.Dispatch {
+		writeRule(&buf, PolicyChain, rule)
+	}
+	for _, chain := range chains {
+		for _, rule := range r.Chains[chain] {
+			writeRule(&buf, chain, rule)
+		}
+	}
+	for _, chain := range stale {
+		fmt.Fprintf(&buf, "-X %s\n", chain)
+	}
+	buf.WriteString("COMMIT\n")
+
+	if err := run(&buf, "iptables-restore", "--noflush", "--wait"); err != nil {
+		return err
+	}
+
+	// 网络策略需要在 addIptables 添加的 ACCEPT 规则之前
+	for _, chain := range []string{"FORWARD", "INPUT"} {
+		exists, err := ipt.Exists("filter", chain, "-j", PolicyChain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert("filter", chain, 1, "-j", PolicyChain); err != nil {
+				return err
+			}
+		}
+	}
+
+	return pruneIPSets(r.Sets)
+}
+
+// writeRule 以 iptables-restore 的格式写入一条规则
+func writeRule(buf *bytes.Buffer, chain string, rule []string) {
+	fmt.Fprintf(buf, "-A %s %s\n", chain, strings.Join(rule, " "))
+}
@@ -0,0 +1,433 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// LocalPod 是本节点上经由宿主机端 veth 接入的 Pod
+type LocalPod struct {
+	Pod      *corev1.Pod
+	IP       net.IP
+	HostVeth string
+}
+
+// Ruleset 是编译得到的 iptables 规则和规则引用的 ipset
+type Ruleset struct {
+	Dispatch [][]string            // PolicyChain 中跳转到 Pod 链的规则
+	Chains   map[string][][]string // 每个 Pod 的入方向和出方向链中的规则
+	Sets     map[string]*IPSet     // 按名称索引的 ipset
+}
+
+// compiler 保存编译过程中需要的集群信息
+type compiler struct {
+	pods       []*corev1.Pod                // 有地址的非 hostNetwork Pod
+	namespaces map[string]map[string]string // 命名空间的标签
+	rs         *Ruleset
+}
+
+// Compile 将 NetworkPolicy 编译为本节点 Pod 的规则
+// 被某个方向的策略选中的 Pod 在该方向只允许策略规则匹配的流量, 其余流量被丢弃, 没有被选中的 Pod 不受限制
+func Compile(policies []networkingv1.NetworkPolicy, pods []corev1.Pod, namespaces []corev1.Namespace, local []LocalPod) *Ruleset {
+	c := &compiler{
+		namespaces: make(map[string]map[string]string),
+		rs: &Ruleset{
+			Chains: make(map[string][][]string),
+			Sets:   make(map[string]*IPSet),
+		},
+	}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = ns.Labels
+	}
+	for i := range pods {
+		if PodIP(&pods[i]) != nil {
+			c.pods = append(c.pods, &pods[i])
+		}
+	}
+
+	// 按名称排序, 使生成的规则稳定
+	sorted := make([]*networkingv1.NetworkPolicy, 0, len(policies))
+	for i := range policies {
+		sorted = append(sorted, &policies[i])
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Namespace+"/"+sorted[i].Name < sorted[j].Namespace+"/"+sorted[j].Name
+	})
+	local = append([]LocalPod(nil), local...)
+	sort.Slice(local, func(i, j int) bool {
+		return podKey(local[i].Pod) < podKey(local[j].Pod)
+	})
+
+	for _, l := range local {
+		var ingress, egress []*networkingv1.NetworkPolicy
+		for _, p := range sorted {
+			if p.Namespace != l.Pod.Namespace || !matchLabels(&p.Spec.PodSelector, l.Pod.Labels) {
+				continue
+			}
+			in, eg := policyTypes(p)
+			if in {
+				ingress = append(ingress, p)
+			}
+			if eg {
+				egress = append(egress, p)
+			}
+		}
+
+		if len(ingress) > 0 {
+			chain := podChain(ingressChainPrefix, l.Pod)
+			c.rs.Dispatch = append(c.rs.Dispatch, withComment(podKey(l.Pod), "-d", l.IP.String()+"/32", "-j", chain))
+			c.rs.Chains[chain] = append(c.ingressRules(ingress, l.Pod), []string{"-j", "DROP"})
+		}
+
+		if len(egress) > 0 {
+			chain := podChain(egressChainPrefix, l.Pod)
+			// ptp 和 flat 模式下报文经由 veth 路由, bridge 模式下经由网桥转发, 需要 br_netfilter
+			c.rs.Dispatch = append(c.rs.Dispatch,
+				withComment(podKey(l.Pod), "-i", l.HostVeth, "-j", chain),
+				withComment(podKey(l.Pod), "-m", "physdev", "--physdev-in", l.HostVeth, "-j", chain))
+			c.rs.Chains[chain] = append(c.egressRules(egress), []string{"-j", "DROP"})
+		}
+	}
+
+	return c.rs
+}
+
+// Selected 判断 Pod 是否被某个策略选中, 不区分方向
+func Selected(policies []networkingv1.NetworkPolicy, pod *corev1.Pod) bool {
+	for i := range policies {
+		p := &policies[i]
+		if p.Namespace == pod.Namespace && matchLabels(&p.Spec.PodSelector, pod.Labels) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ingressRules 生成 Pod 入方向允许的流量, 命名端口根据 Pod 自身的容器端口解析
+func (c *compiler) ingressRules(policies []*networkingv1.NetworkPolicy, pod *corev1.Pod) [][]string {
+	var rules [][]string
+	for _, p := range policies {
+		for i, rule := range p.Spec.Ingress {
+			var ports [][]string
+			for _, port := range rule.Ports {
+				if match, ok := portMatch(port, pod); ok {
+					ports = append(ports, match)
+				}
+			}
+			// 端口都无法解析时规则不匹配任何流量
+			if len(rule.Ports) > 0 && len(ports) == 0 {
+				continue
+			}
+			if len(rule.Ports) == 0 {
+				ports = [][]string{nil}
+			}
+
+			for _, peer := range c.peerMatches(p, "ingress", i, rule.From, "src") {
+				for _, port := range ports {
+					rules = append(rules, allow(p, peer, port))
+				}
+			}
+		}
+	}
+
+	return rules
+}
+
+// egressRules 生成 Pod 出方向允许的流量, 命名端口根据目的 Pod 的容器端口解析, 只匹配 Pod 地址
+func (c *compiler) egressRules(policies []*networkingv1.NetworkPolicy) [][]string {
+	var rules [][]string
+	for _, p := range policies {
+		for i, rule := range p.Spec.Egress {
+			var ports [][]string
+			var named []networkingv1.NetworkPolicyPort
+			for _, port := range rule.Ports {
+				if port.Port != nil && port.Port.Type == intstr.String {
+					named = append(named, port)
+					continue
+				}
+				match, _ := portMatch(port, nil)
+				ports = append(ports, match)
+			}
+			if len(rule.Ports) == 0 {
+				ports = [][]string{nil}
+			}
+
+			if len(ports) > 0 {
+				for _, peer := range c.peerMatches(p, "egress", i, rule.To, "dst") {
+					for _, port := range ports {
+						rules = append(rules, allow(p, peer, port))
+					}
+				}
+			}
+
+			if len(named) == 0 {
+				continue
+			}
+			// 没有 to 时匹配所有 Pod 的命名端口
+			var targets []*corev1.Pod
+			if len(rule.To) == 0 {
+				targets = c.pods
+			}
+			for _, peer := range rule.To {
+				if peer.IPBlock == nil {
+					targets = append(targets, c.selectPods(p.Namespace, peer)...)
+				}
+			}
+			for _, port := range named {
+				// 按解析得到的端口号分组, 每组一个 ipset
+				groups := make(map[string][]string)
+				for _, target := range targets {
+					if match, ok := portMatch(port, target); ok {
+						key := strings.Join(match, " ")
+						groups[key] = append(groups[key], PodIP(target).String())
+					}
+				}
+				keys := make([]string, 0, len(groups))
+				for key := range groups {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					set := c.addSet(fmt.Sprintf("%s/%s/egress/%d/%s/%s", p.Namespace, p.Name, i, port.Port.StrVal, key), setTypeIP, groups[key])
+					rules = append(rules, allow(p, setMatch(set, "dst"), strings.Fields(key)))
+				}
+			}
+		}
+	}
+
+	return rules
+}
+
+// peerMatches 生成匹配规则中每个对端的参数, 没有对端时匹配所有地址, 不匹配任何地址的对端被忽略
+func (c *compiler) peerMatches(p *networkingv1.NetworkPolicy, direction string, rule int, peers []networkingv1.NetworkPolicyPeer, flag string) [][]string {
+	if len(peers) == 0 {
+		return [][]string{nil}
+	}
+
+	var matches [][]string
+	for i, peer := range peers {
+		key := fmt.Sprintf("%s/%s/%s/%d/%d", p.Namespace, p.Name, direction, rule, i)
+
+		if peer.IPBlock != nil {
+			entries := ipBlockEntries(peer.IPBlock)
+			if len(entries) > 0 {
+				matches = append(matches, setMatch(c.addSet(key, setTypeNet, entries), flag))
+			}
+			continue
+		}
+
+		var ips []string
+		for _, pod := range c.selectPods(p.Namespace, peer) {
+			ips = append(ips, PodIP(pod).String())
+		}
+		if len(ips) > 0 {
+			matches = append(matches, setMatch(c.addSet(key, setTypeIP, ips), flag))
+		}
+	}
+
+	return matches
+}
+
+// selectPods 返回对端选中的 Pod
+// 只有 podSelector 时选择策略所在命名空间的 Pod, 有 namespaceSelector 时选择匹配的命名空间中的 Pod
+func (c *compiler) selectPods(namespace string, peer networkingv1.NetworkPolicyPeer) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, pod := range c.pods {
+		if peer.NamespaceSelector == nil {
+			if pod.Namespace != namespace {
+				continue
+			}
+		} else if !matchLabels(peer.NamespaceSelector, c.namespaces[pod.Namespace]) {
+			continue
+		}
+		if peer.PodSelector != nil && !matchLabels(peer.PodSelector, pod.Labels) {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+
+	return pods
+}
+
+// addSet 添加内容为 entries 的 ipset, 名称由 key 和类型生成
+// 同一个 key 的内容不随本节点 Pod 变化, 多个 Pod 的链共用一个 ipset
+func (c *compiler) addSet(key, typ string, entries []string) *IPSet {
+	name := setName(typ + "/" + key)
+	if set, ok := c.rs.Sets[name]; ok {
+		return set
+	}
+
+	set := &IPSet{Name: name, Type: typ, Entries: entries}
+	c.rs.Sets[name] = set
+
+	return set
+}
+
+// ipBlockEntries 将 ipBlock 转换为 hash:net 的条目, except 作为 nomatch 条目, 只支持 IPv4
+func ipBlockEntries(block *networkingv1.IPBlock) []string {
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if err != nil || cidr.IP.To4() == nil {
+		return nil
+	}
+
+	// hash:net 不支持 /0, 拆分为两个 /1
+	var entries []string
+	if ones, _ := cidr.Mask.Size(); ones == 0 {
+		entries = append(entries, "0.0.0.0/1", "128.0.0.0/1")
+	} else {
+		entries = append(entries, cidr.String())
+	}
+
+	for _, except := range block.Except {
+		_, e, err := net.ParseCIDR(except)
+		if err != nil || e.IP.To4() == nil {
+			continue
+		}
+		if ones, _ := e.Mask.Size(); ones == 0 {
+			return nil
+		}
+		entries = append(entries, e.String()+" nomatch")
+	}
+
+	return entries
+}
+
+// portMatch 生成匹配端口的参数, 命名端口根据 pod 的容器端口解析, 无法解析时返回 false
+func portMatch(port networkingv1.NetworkPolicyPort, pod *corev1.Pod) ([]string, bool) {
+	protocol := corev1.ProtocolTCP
+	if port.Protocol != nil {
+		protocol = *port.Protocol
+	}
+	match := []string{"-p", strings.ToLower(string(protocol))}
+
+	if port.Port == nil {
+		return match, true
+	}
+
+	number := port.Port.IntVal
+	if port.Port.Type == intstr.String {
+		number = namedPort(pod, port.Port.StrVal, protocol)
+		if number == 0 {
+			return nil, false
+		}
+	}
+
+	dport := strconv.Itoa(int(number))
+	if port.EndPort != nil && port.Port.Type == intstr.Int && *port.EndPort > number {
+		dport += ":" + strconv.Itoa(int(*port.EndPort))
+	}
+
+	return append(match, "--dport", dport), true
+}
+
+// namedPort 返回 Pod 中名称和协议都匹配的容器端口, 没有时返回 0
+func namedPort(pod *corev1.Pod, name string, protocol corev1.Protocol) int32 {
+	if pod == nil {
+		return 0
+	}
+
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			p := port.Protocol
+			if p == "" {
+				p = corev1.ProtocolTCP
+			}
+			if port.Name == name && p == protocol {
+				return port.ContainerPort
+			}
+		}
+	}
+
+	return 0
+}
+
+// policyTypes 返回策略是否作用于入方向和出方向, 没有 policyTypes 时总是作用于入方向, 有 egress 规则时作用于出方向
+func policyTypes(p *networkingv1.NetworkPolicy) (bool, bool) {
+	if len(p.Spec.PolicyTypes) == 0 {
+		return true, len(p.Spec.Egress) > 0
+	}
+
+	var ingress, egress bool
+	for _, t := range p.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+
+	return ingress, egress
+}
+
+// matchLabels 判断标签是否匹配选择器, 无效的选择器不匹配任何标签
+func matchLabels(selector *metav1.LabelSelector, l map[string]string) bool {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false
+	}
+
+	return s.Matches(labels.Set(l))
+}
+
+// PodIP 返回 Pod 的 IPv4 地址, hostNetwork 的 Pod 和已经结束的 Pod 返回 nil
+func PodIP(pod *corev1.Pod) net.IP {
+	if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+
+	for _, podIP := range pod.Status.PodIPs {
+		if ip := net.ParseIP(podIP.IP).To4(); ip != nil {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// allow 生成允许匹配 peer 和 port 的流量的规则, 允许的流量返回 PolicyChain 继续匹配另一个方向
+func allow(p *networkingv1.NetworkPolicy, peer, port []string) []string {
+	rule := append(append([]string(nil), peer...), port...)
+	return append(rule, "-m", "comment", "--comment", p.Namespace+"/"+p.Name, "-j", "RETURN")
+}
+
+// setMatch 生成匹配 ipset 的参数, flag 为 src 或 dst
+func setMatch(set *IPSet, flag string) []string {
+	return []string{"-m", "set", "--match-set", set.Name, flag}
+}
+
+// withComment 生成带有注释的规则
+func withComment(comment string, args ...string) []string {
+	return append([]string{"-m", "comment", "--comment", comment}, args...)
+}
+
+// podChain 返回 Pod 的链名称, 链名称最长 28 个字符
+func podChain(prefix string, pod *corev1.Pod) string {
+	return prefix + hash(podKey(pod))
+}
+
+// setName 返回 ipset 的名称, ipset 名称最长 31 个字符
+func setName(key string) string {
+	return setPrefix + hash(key)
+}
+
+func podKey(pod *corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
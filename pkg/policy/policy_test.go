@@ -0,0 +1,238 @@
+package policy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// newPod 创建运行中的 Pod, ports 为容器端口
+func newPod(namespace, name, ip string, labels map[string]string, ports ...corev1.ContainerPort) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Ports: ports}},
+		},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIPs: []corev1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+// newPolicy 创建选中 app=web 的 Pod 的策略
+func newPolicy(name string, spec networkingv1.NetworkPolicySpec) networkingv1.NetworkPolicy {
+	spec.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	return networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       spec,
+	}
+}
+
+// compile 编译策略, web 是本节点唯一的 Pod
+func compile(policies []networkingv1.NetworkPolicy, web corev1.Pod, others ...corev1.Pod) *Ruleset {
+	pods := append([]corev1.Pod{web}, others...)
+	namespaces := []corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "default"}}}
+	local := []LocalPod{{Pod: &pods[0], IP: PodIP(&pods[0]), HostVeth: "veth0"}}
+
+	return Compile(policies, pods, namespaces, local)
+}
+
+// ruleSet 返回规则引用的 ipset
+func ruleSet(t *testing.T, rs *Ruleset, rule []string) *IPSet {
+	t.Helper()
+
+	for i, arg := range rule {
+		if arg == "--match-set" && i+1 < len(rule) {
+			set, ok := rs.Sets[rule[i+1]]
+			if !ok {
+				t.Fatalf("rule %v references unknown set %s", rule, rule[i+1])
+			}
+			return set
+		}
+	}
+	t.Fatalf("rule %v does not match a set", rule)
+
+	return nil
+}
+
+func containsArgs(rule []string, args ...string) bool {
+	return strings.Contains(" "+strings.Join(rule, " ")+" ", " "+strings.Join(args, " ")+" ")
+}
+
+func TestCompileIPBlockExcept(t *testing.T) {
+	web := newPod("default", "web", "10.244.1.2", map[string]string{"app": "web"})
+	p := newPolicy("allow-cidr", networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			From: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}}},
+				{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: []string{"192.168.0.0/16"}}},
+			},
+		}},
+	})
+
+	rs := compile([]networkingv1.NetworkPolicy{p}, web)
+	rules := rs.Chains[podChain(ingressChainPrefix, &web)]
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 2 allow rules and drop: %v", len(rules), rules)
+	}
+
+	set := ruleSet(t, rs, rules[0])
+	if set.Type != setTypeNet || !reflect.DeepEqual(set.Entries, []string{"10.0.0.0/8", "10.1.0.0/16 nomatch"}) {
+		t.Fatalf("unexpected set %+v", set)
+	}
+	if !containsArgs(rules[0], set.Name, "src") {
+		t.Fatalf("rule %v does not match the source", rules[0])
+	}
+
+	// hash:net 不支持 /0
+	set = ruleSet(t, rs, rules[1])
+	if !reflect.DeepEqual(set.Entries, []string{"0.0.0.0/1", "128.0.0.0/1", "192.168.0.0/16 nomatch"}) {
+		t.Fatalf("unexpected set %+v", set)
+	}
+
+	if !reflect.DeepEqual(rules[2], []string{"-j", "DROP"}) {
+		t.Fatalf("got last rule %v, want drop", rules[2])
+	}
+}
+
+func TestCompileNamedPort(t *testing.T) {
+	web := newPod("default", "web", "10.244.1.2", map[string]string{"app": "web"},
+		corev1.ContainerPort{Name: "http", ContainerPort: 8080})
+	dns := newPod("default", "dns", "10.244.2.3", map[string]string{"app": "dns"},
+		corev1.ContainerPort{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP})
+	udp := corev1.ProtocolUDP
+	p := newPolicy("named", networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{
+			{Ports: []networkingv1.NetworkPolicyPort{{Port: ptr(intstr.FromString("http"))}}},
+			// web 没有 metrics 端口, 规则不匹配任何流量
+			{Ports: []networkingv1.NetworkPolicyPort{{Port: ptr(intstr.FromString("metrics"))}}},
+		},
+		Egress: []networkingv1.NetworkPolicyEgressRule{{
+			To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "dns"}}}},
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: ptr(intstr.FromString("dns"))}},
+		}},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+	})
+
+	rs := compile([]networkingv1.NetworkPolicy{p}, web, dns)
+
+	// 入方向的命名端口根据 web 自身的容器端口解析
+	ingress := rs.Chains[podChain(ingressChainPrefix, &web)]
+	if len(ingress) != 2 || !containsArgs(ingress[0], "-p", "tcp", "--dport", "8080") {
+		t.Fatalf("unexpected ingress rules %v", ingress)
+	}
+
+	// 出方向的命名端口根据目的 Pod 的容器端口解析, 目的地址放在 ipset 中
+	egress := rs.Chains[podChain(egressChainPrefix, &web)]
+	if len(egress) != 2 || !containsArgs(egress[0], "-p", "udp", "--dport", "53") {
+		t.Fatalf("unexpected egress rules %v", egress)
+	}
+	set := ruleSet(t, rs, egress[0])
+	if set.Type != setTypeIP || !reflect.DeepEqual(set.Entries, []string{"10.244.2.3"}) {
+		t.Fatalf("unexpected set %+v", set)
+	}
+	if !containsArgs(egress[0], set.Name, "dst") {
+		t.Fatalf("rule %v does not match the destination", egress[0])
+	}
+}
+
+func TestCompilePolicyTypesDefault(t *testing.T) {
+	web := newPod("default", "web", "10.244.1.2", map[string]string{"app": "web"})
+
+	// 没有 policyTypes 和 egress 规则时只作用于入方向, 没有规则时拒绝所有入方向流量
+	deny := newPolicy("deny", networkingv1.NetworkPolicySpec{})
+	rs := compile([]networkingv1.NetworkPolicy{deny}, web)
+	if rules := rs.Chains[podChain(ingressChainPrefix, &web)]; !reflect.DeepEqual(rules, [][]string{{"-j", "DROP"}}) {
+		t.Fatalf("got ingress rules %v, want drop", rules)
+	}
+	if _, ok := rs.Chains[podChain(egressChainPrefix, &web)]; ok {
+		t.Fatalf("egress chain created without egress rules")
+	}
+	if len(rs.Dispatch) != 1 || !containsArgs(rs.Dispatch[0], "-d", "10.244.1.2/32") {
+		t.Fatalf("unexpected dispatch %v", rs.Dispatch)
+	}
+
+	// 有 egress 规则时也作用于出方向
+	egress := newPolicy("egress", networkingv1.NetworkPolicySpec{
+		Egress: []networkingv1.NetworkPolicyEgressRule{{}},
+	})
+	rs = compile([]networkingv1.NetworkPolicy{egress}, web)
+	if rules := rs.Chains[podChain(ingressChainPrefix, &web)]; !reflect.DeepEqual(rules, [][]string{{"-j", "DROP"}}) {
+		t.Fatalf("got ingress rules %v, want drop", rules)
+	}
+	if rules := rs.Chains[podChain(egressChainPrefix, &web)]; len(rules) != 2 {
+		t.Fatalf("got egress rules %v, want allow all and drop", rules)
+	}
+}
+
+func TestCompileEgressOnly(t *testing.T) {
+	web := newPod("default", "web", "10.244.1.2", map[string]string{"app": "web"})
+	db := newPod("default", "db", "10.244.2.3", map[string]string{"app": "db"})
+	p := newPolicy("egress-only", networkingv1.NetworkPolicySpec{
+		Egress: []networkingv1.NetworkPolicyEgressRule{{
+			To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}},
+			Ports: []networkingv1.NetworkPolicyPort{{Port: ptr(intstr.FromInt32(5432))}},
+		}},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+	})
+
+	rs := compile([]networkingv1.NetworkPolicy{p}, web, db)
+	if _, ok := rs.Chains[podChain(ingressChainPrefix, &web)]; ok {
+		t.Fatalf("ingress chain created for an egress-only policy")
+	}
+
+	// bridge 模式经由 physdev 匹配, ptp 和 flat 模式经由入接口匹配
+	chain := podChain(egressChainPrefix, &web)
+	if len(rs.Dispatch) != 2 || !containsArgs(rs.Dispatch[0], "-i", "veth0", "-j", chain) ||
+		!containsArgs(rs.Dispatch[1], "--physdev-in", "veth0", "-j", chain) {
+		t.Fatalf("unexpected dispatch %v", rs.Dispatch)
+	}
+
+	rules := rs.Chains[chain]
+	if len(rules) != 2 || !containsArgs(rules[0], "-p", "tcp", "--dport", "5432") || !reflect.DeepEqual(rules[1], []string{"-j", "DROP"}) {
+		t.Fatalf("unexpected egress rules %v", rules)
+	}
+	set := ruleSet(t, rs, rules[0])
+	if !reflect.DeepEqual(set.Entries, []string{"10.244.2.3"}) {
+		t.Fatalf("unexpected set %+v", set)
+	}
+}
+
+func TestSelected(t *testing.T) {
+	web := newPod("default", "web", "10.244.1.2", map[string]string{"app": "web"})
+	db := newPod("default", "db", "10.244.1.3", map[string]string{"app": "db"})
+	other := newPod("other", "web", "10.244.1.4", map[string]string{"app": "web"})
+	policies := []networkingv1.NetworkPolicy{newPolicy("deny", networkingv1.NetworkPolicySpec{})}
+
+	if !Selected(policies, &web) {
+		t.Fatalf("web is not selected")
+	}
+	// 策略只选中同一个命名空间中标签匹配的 Pod
+	if Selected(policies, &db) || Selected(policies, &other) {
+		t.Fatalf("pods without a matching policy are selected")
+	}
+}
+
+func TestPodIP(t *testing.T) {
+	pod := newPod("default", "web", "10.244.1.2", nil)
+	pod.Status.PodIPs = append([]corev1.PodIP{{IP: "fd00::2"}}, pod.Status.PodIPs...)
+	if ip := PodIP(&pod); !ip.Equal(net.ParseIP("10.244.1.2")) {
+		t.Fatalf("got %s, want the ipv4 address", ip)
+	}
+
+	pod.Spec.HostNetwork = true
+	if ip := PodIP(&pod); ip != nil {
+		t.Fatalf("got %s for a hostNetwork pod", ip)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
@@ -15,14 +16,18 @@ const (
 
 // containerNetInfo 存储容器网络信息
 type containerNetInfo struct {
-	ID     string `json:"id"`     // 容器ID
-	IfName string `json:"ifName"` // 容器网卡名称
+	ID       string `json:"id"`                 // 容器ID
+	IfName   string `json:"ifName"`             // 容器网卡名称
+	HostVeth string `json:"hostVeth,omitempty"` // 宿主机端 veth 名称
+	Mac      string `json:"mac,omitempty"`      // 容器网卡的 MAC 地址
+	Chained  bool   `json:"chained,omitempty"`  // veth 是否由之前的插件创建
 }
 
 // Data 存储所有容器网络信息
 type Data struct {
-	Ips  map[string]containerNetInfo `json:"ips"`  // 存储容器网络信息
-	Last string                      `json:"last"` // 存储最后一次使用的容器ID
+	Ips     map[string]containerNetInfo `json:"ips"`               // 存储容器网络信息
+	Last    string                      `json:"last"`              // 存储最后一次使用的容器ID
+	Tenants map[string]string           `json:"tenants,omitempty"` // 容器ID到 ADD 时选择的租户网络
 }
 
 // Store 存储器
@@ -59,12 +64,39 @@ func NewStore(dataDir, network string) (*Store, error) {
 	dataFile := filepath.Join(dir, network+".json")
 
 	// 创建存储数据
-	data := &Data{Ips: make(map[string]containerNetInfo)}
+	data := &Data{Ips: make(map[string]containerNetInfo), Tenants: make(map[string]string)}
 
 	// 返回存储器
 	return &Store{FileMutex: fileLock, dir: dir, data: data, dataFile: dataFile}, nil
 }
 
+// Networks 返回 dataDir 中已经有存储文件的网络名称, 同一目录下其他插件的数据被忽略
+func Networks(dataDir string) ([]string, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var networks []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, e.Name(), e.Name()+".json")); err == nil {
+			networks = append(networks, e.Name())
+		}
+	}
+
+	return networks, nil
+}
+
 // LocalData 获取本地存储数据
 func (s *Store) LocalData() error {
 	// 创建空数据
@@ -96,6 +128,9 @@ func (s *Store) LocalData() error {
 	if data.Ips == nil {
 		data.Ips = make(map[string]containerNetInfo)
 	}
+	if data.Tenants == nil {
+		data.Tenants = make(map[string]string)
+	}
 
 	s.data = data
 
@@ -119,11 +154,96 @@ func (s *Store) GetIPByContainerID(id string) (net.IP, bool) {
 	return nil, false
 }
 
+// GetLinkByContainerID 根据容器 ID 获取宿主机端 veth 名称和容器网卡的 MAC 地址
+func (s *Store) GetLinkByContainerID(id string) (string, string, bool) {
+	for _, info := range s.data.Ips {
+		if info.ID == id {
+			return info.HostVeth, info.Mac, true
+		}
+	}
+
+	return "", "", false
+}
+
+// Chained 判断容器的 veth 是否由之前的插件创建
+func (s *Store) Chained(id string) bool {
+	for _, info := range s.data.Ips {
+		if info.ID == id {
+			return info.Chained
+		}
+	}
+
+	return false
+}
+
+// SetChained 记录容器的 veth 由之前的插件创建, DEL 时只将其从网桥中移除
+func (s *Store) SetChained(id string) error {
+	for ip, info := range s.data.Ips {
+		if info.ID == id {
+			info.Chained = true
+			s.data.Ips[ip] = info
+
+			return s.Store()
+		}
+	}
+
+	return fmt.Errorf("failed to find container %s", id)
+}
+
+// HostVeths 返回 IP 地址到宿主机端 veth 名称的映射, 没有记录 veth 的容器被忽略
+func (s *Store) HostVeths() map[string]string {
+	veths := make(map[string]string)
+	for ip, info := range s.data.Ips {
+		if info.HostVeth != "" {
+			veths[ip] = info.HostVeth
+		}
+	}
+
+	return veths
+}
+
+// SetLink 记录容器的宿主机端 veth 名称和容器网卡的 MAC 地址
+func (s *Store) SetLink(id, hostVeth, mac string) error {
+	for ip, info := range s.data.Ips {
+		if info.ID == id {
+			info.HostVeth = hostVeth
+			info.Mac = mac
+			s.data.Ips[ip] = info
+
+			return s.Store()
+		}
+	}
+
+	return fmt.Errorf("failed to find container %s", id)
+}
+
+// Tenant 获取 ADD 时为容器选择的租户网络
+func (s *Store) Tenant(id string) (string, bool) {
+	network, ok := s.data.Tenants[id]
+	return network, ok
+}
+
+// SetTenant 记录为容器选择的租户网络
+func (s *Store) SetTenant(id, network string) error {
+	s.data.Tenants[id] = network
+	return s.Store()
+}
+
+// DelTenant 删除容器的租户网络记录
+func (s *Store) DelTenant(id string) error {
+	if _, ok := s.data.Tenants[id]; !ok {
+		return nil
+	}
+
+	delete(s.data.Tenants, id)
+	return s.Store()
+}
+
 // Add 添加 IP 地址和容器信息
 func (s *Store) Add(ip net.IP, id, ifName string) error {
 	if len(ip) > 0 {
-		s.data.Ips[ip.String()] = containerNetInfo{id, ifName} // 添加 IP 地址和容器信息
-		s.data.Last = ip.String()                              // 更新最后一次使用的容器 ID
+		s.data.Ips[ip.String()] = containerNetInfo{ID: id, IfName: ifName} // 添加 IP 地址和容器信息
+		s.data.Last = ip.String()                                          // 更新最后一次使用的容器 ID
 
 		return s.Store() // 存储数据
 	}